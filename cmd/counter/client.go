@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/matbits/counter/pkg/counter"
+	"github.com/matbits/counter/pkg/lockfile"
+)
+
+// usage prints the commands and flags of the program.
+func usage() {
+	out := flag.CommandLine.Output()
+
+	fmt.Fprintf(out, `Usage: counter [flags] [command] [flags] [value]
+
+Commands:
+  serve      run the HTTP server (default)
+  get        print the counter
+  set VALUE  set the counter to VALUE
+  inc        add -step to the counter
+  verify     check that -file holds a valid counter
+
+get, set and inc send the request to the server holding the lock file.
+If no server is running, they change the counter file directly.
+
+Flags:
+`)
+	flag.PrintDefaults()
+}
+
+// runCommand runs the client command with args and prints the resulting
+// value. If another process holds lockFile, the command is sent to the
+// server listening on listenAddr, otherwise the counter file is changed
+// directly while holding the lock. In memory mode there is no file, so
+// the command is always sent to the server.
+func runCommand(command string, args []string, lockFile string) error {
+	var value int64
+
+	switch {
+	case command == "set" && len(args) == 1:
+		var err error
+
+		value, err = parseInt(args[0])
+		if err != nil {
+			return err
+		}
+	case command == "set":
+		return errors.New("set requires exactly one value")
+	case len(args) != 0:
+		return fmt.Errorf("%s takes no arguments", command)
+	}
+
+	if memory {
+		result, err := runRemote(command, value)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(result)
+
+		return nil
+	}
+
+	flock := lockfile.NewLockfile(lockFile)
+
+	locked, err := flock.TryLockWrite()
+	if err != nil {
+		return err
+	}
+
+	var result int64
+
+	if locked {
+		result, err = runLocal(command, value)
+
+		uerr := flock.Unlock()
+		if err == nil {
+			err = uerr
+		}
+	} else {
+		result, err = runRemote(command, value)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(result)
+
+	return nil
+}
+
+// runLocal runs command on the counter file. The caller must hold the
+// lock file.
+func runLocal(command string, value int64) (int64, error) {
+	start, err := initialValue()
+	if err != nil {
+		return 0, err
+	}
+
+	store, err := newStore(storeKind, start)
+	if err != nil {
+		return 0, err
+	}
+
+	c, err := counter.New(store)
+	if err != nil {
+		return 0, err
+	}
+
+	defer c.Close()
+
+	c.Min = minNumber
+	c.Max = maxNumber
+
+	switch command {
+	case "set":
+		return value, c.Set(value)
+	case "inc":
+		return c.Add(step)
+	default:
+		return c.Value(), nil
+	}
+}
+
+// runRemote sends command to the server listening on listenAddr and
+// returns the value it responds with.
+func runRemote(command string, value int64) (int64, error) {
+	method, path := http.MethodGet, "/latest"
+
+	switch command {
+	case "set":
+		method, path = http.MethodPut, "/set?value="+strconv.FormatInt(value, 10)
+	case "inc":
+		method, path = http.MethodPost, "/hostname"
+	}
+
+	req, err := http.NewRequest(method, serverURL(path), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	if authToken != "" {
+		req.Header.Set("Authorization", "Bearer "+authToken)
+	}
+
+	resp, err := httpClient().Do(req)
+	if err != nil {
+		return 0, err
+	}
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("server responded with %s", resp.Status)
+	}
+
+	return parseInt(string(body))
+}
+
+// serverURL returns the URL of path on the server listening on
+// listenAddr. Wildcard addresses and Unix sockets are reached through
+// localhost.
+func serverURL(path string) string {
+	scheme := "http"
+	if tlsCert != "" {
+		scheme = "https"
+	}
+
+	if network, _ := listenNetwork(listenAddr); network == "unix" {
+		return scheme + "://localhost" + path
+	}
+
+	host, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return scheme + "://" + listenAddr + path
+	}
+
+	if host == "" || net.ParseIP(host).IsUnspecified() {
+		host = "localhost"
+	}
+
+	return scheme + "://" + net.JoinHostPort(host, port) + path
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// loadConfig reads the settings of path into the flags of the same name.
+// Flags set on the command line take precedence over the file. Keys not
+// matching a flag are logged and ignored. Files ending in .toml are read
+// as flat TOML, everything else as a JSON object.
+func loadConfig(path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var values map[string]string
+
+	if filepath.Ext(path) == ".toml" {
+		values, err = parseTOML(content)
+	} else {
+		values, err = parseJSONConfig(content)
+	}
+
+	if err != nil {
+		return fmt.Errorf("unable to parse '%s': %w", path, err)
+	}
+
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	for key, value := range values {
+		if key == "config" || flag.Lookup(key) == nil {
+			slog.Warn("unknown config key", "file", path, "key", key)
+
+			continue
+		}
+
+		if explicit[key] {
+			continue
+		}
+
+		err = flag.Set(key, value)
+		if err != nil {
+			return fmt.Errorf("invalid value for '%s': %w", key, err)
+		}
+	}
+
+	return nil
+}
+
+// parseJSONConfig reads a JSON object with string, number or boolean
+// values.
+func parseJSONConfig(content []byte) (map[string]string, error) {
+	var raw map[string]any
+
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+
+	err := decoder.Decode(&raw)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string, len(raw))
+
+	for key, value := range raw {
+		switch v := value.(type) {
+		case string:
+			values[key] = v
+		case json.Number:
+			values[key] = v.String()
+		case bool:
+			values[key] = strconv.FormatBool(v)
+		default:
+			return nil, fmt.Errorf("unsupported value for '%s'", key)
+		}
+	}
+
+	return values, nil
+}
+
+// parseTOML reads the top level key/value pairs of a TOML document.
+// Tables and arrays are not supported as no setting needs them.
+func parseTOML(content []byte) (map[string]string, error) {
+	values := make(map[string]string)
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", lineNo)
+		}
+
+		key = strings.Trim(strings.TrimSpace(key), `"`)
+		value = strings.TrimSpace(value)
+
+		if strings.HasPrefix(value, `"`) {
+			quoted, err := strconv.QuotedPrefix(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+
+			// only a comment may follow the closing quote
+			rest := strings.TrimSpace(value[len(quoted):])
+			if rest != "" && !strings.HasPrefix(rest, "#") {
+				return nil, fmt.Errorf("line %d: unexpected '%s' after value", lineNo, rest)
+			}
+
+			value, err = strconv.Unquote(quoted)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNo, err)
+			}
+		} else if comment := strings.Index(value, "#"); comment >= 0 {
+			value = strings.TrimSpace(value[:comment])
+		}
+
+		values[key] = value
+	}
+
+	return values, scanner.Err()
+}
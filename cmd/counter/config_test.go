@@ -0,0 +1,39 @@
+package main
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestParseTOML(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]string
+		wantErr bool
+	}{
+		{name: "quoted", content: `file = "x"`, want: map[string]string{"file": "x"}},
+		{name: "quoted with comment", content: `file = "x" # note`, want: map[string]string{"file": "x"}},
+		{name: "quoted hash", content: `file = "a#b" # note`, want: map[string]string{"file": "a#b"}},
+		{name: "escaped quote", content: `file = "a\"b" # "c"`, want: map[string]string{"file": `a"b`}},
+		{name: "bare with comment", content: "step = 5 # five", want: map[string]string{"step": "5"}},
+		{name: "comment line", content: "# comment\nwal = true", want: map[string]string{"wal": "true"}},
+		{name: "quoted key", content: `"file" = "x"`, want: map[string]string{"file": "x"}},
+		{name: "text after value", content: `file = "x" y`, wantErr: true},
+		{name: "unterminated", content: `file = "x`, wantErr: true},
+		{name: "missing equals", content: "file", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTOML([]byte(tt.content))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTOML() error = %v, want error %v", err, tt.wantErr)
+			}
+
+			if !tt.wantErr && !maps.Equal(got, tt.want) {
+				t.Errorf("parseTOML() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
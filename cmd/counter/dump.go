@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/matbits/counter/pkg/fhandler"
+)
+
+// stateDump is the diagnostic snapshot written on a dump signal.
+type stateDump struct {
+	Time             time.Time `json:"time"`
+	Value            int64     `json:"value"`
+	UptimeSeconds    float64   `json:"uptime_seconds"`
+	HostnameRequests int64     `json:"hostname_requests"`
+	LatestRequests   int64     `json:"latest_requests"`
+	IncrementsTotal  int64     `json:"increments_total"`
+	InFlight         int64     `json:"in_flight"`
+	PersistFailures  int64     `json:"persist_failures"`
+	// LockFile is the lock file held by the server, LockOwner the pid of
+	// this process holding it. Both are empty if no lock is held, as in
+	// memory mode.
+	LockFile  string `json:"lock_file,omitempty"`
+	LockOwner int    `json:"lock_owner,omitempty"`
+}
+
+// dumpLoop writes a stateDump to dumpFile whenever c receives a signal.
+// lockFile is the lock file held by the server, empty if it holds none.
+// Only reading the value takes the counter lock, the write happens
+// without it.
+func dumpLoop(c chan os.Signal, lockFile string) {
+	path := dumpFile
+	if path == "" {
+		path = fileName + ".dump.json"
+	}
+
+	owner := 0
+	if lockFile != "" {
+		owner = os.Getpid()
+	}
+
+	for range c {
+		now := clk.Now()
+
+		out, err := json.MarshalIndent(stateDump{
+			Time:             now,
+			Value:            ctr.Value(),
+			UptimeSeconds:    now.Sub(stats.Start).Seconds(),
+			HostnameRequests: stats.HostnameRequests.Load(),
+			LatestRequests:   stats.LatestRequests.Load(),
+			IncrementsTotal:  stats.IncrementsTotal.Load(),
+			InFlight:         stats.InFlight.Load(),
+			PersistFailures:  stats.PersistFailures.Load(),
+			LockFile:         lockFile,
+			LockOwner:        owner,
+		}, "", "  ")
+		if err != nil {
+			slog.Error("unable to marshal state dump", "error", err)
+
+			continue
+		}
+
+		err = fhandler.WriteAtomic("", ".counter-dump", path, append(out, '\n'), 0644)
+		if err != nil {
+			slog.Error("unable to write state dump", "file", path, "error", err)
+
+			continue
+		}
+
+		slog.Info("wrote state dump", "file", path)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !openbsd && !netbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!openbsd,!netbsd,!dragonfly
+
+package main
+
+import (
+	"os"
+)
+
+// dumpSignals is empty, there is no user signal on this platform.
+var dumpSignals []os.Signal
@@ -0,0 +1,12 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd || dragonfly
+// +build linux darwin freebsd openbsd netbsd dragonfly
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// dumpSignals trigger a state dump.
+var dumpSignals = []os.Signal{syscall.SIGUSR1}
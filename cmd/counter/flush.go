@@ -0,0 +1,46 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/matbits/counter/pkg/counter"
+)
+
+// flushLoop persists the counter every interval if it changed. A failed
+// write is retried by the next flush.
+func flushLoop(interval time.Duration) {
+	for {
+		<-clk.After(interval)
+
+		err := ctr.Flush()
+		if err != nil {
+			slog.Error("unable to flush counter", "file", fileName, "error", err)
+		}
+	}
+}
+
+// compactLoop compacts the write-ahead log of s every interval.
+func compactLoop(s *counter.WALStore, interval time.Duration) {
+	for {
+		<-clk.After(interval)
+
+		err := s.Compact()
+		if err != nil {
+			slog.Error("unable to compact write-ahead log", "file", fileName, "error", err)
+		}
+	}
+}
+
+// snapshotLoop saves the counter every interval if it changed since the
+// last snapshot.
+func snapshotLoop(interval time.Duration) {
+	for {
+		<-clk.After(interval)
+
+		err := ctr.Snapshot()
+		if err != nil {
+			slog.Error("unable to snapshot counter", "file", fileName, "error", err)
+		}
+	}
+}
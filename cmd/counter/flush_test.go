@@ -0,0 +1,83 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/matbits/counter/pkg/clock"
+	"github.com/matbits/counter/pkg/counter"
+)
+
+// countingStore is a MemoryStore counting its saves.
+type countingStore struct {
+	counter.MemoryStore
+	saves atomic.Int32
+}
+
+func (s *countingStore) Save(value int64) error {
+	s.saves.Add(1)
+
+	return s.MemoryStore.Save(value)
+}
+
+func TestSaveLoops(t *testing.T) {
+	tests := []struct {
+		name string
+		loop func(time.Duration)
+	}{
+		{name: "flush", loop: flushLoop},
+		{name: "snapshot", loop: snapshotLoop},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &countingStore{}
+
+			c, err := counter.New(store)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c.WriteBehind = true
+
+			fake := clock.NewFake(time.Now())
+
+			// the loop never ends, but it only touches the globals again
+			// once its clock is advanced
+			ctr, clk = c, fake
+
+			go tt.loop(time.Minute)
+
+			_, err = c.Add(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			steps := []struct {
+				advance   time.Duration
+				wantSaves int32
+			}{
+				{advance: time.Minute - 1, wantSaves: 0},
+				{advance: 1, wantSaves: 1},
+				// unchanged since the last save
+				{advance: time.Minute, wantSaves: 1},
+			}
+
+			var elapsed time.Duration
+
+			for _, step := range steps {
+				fake.BlockUntil(1)
+				fake.Advance(step.advance)
+				elapsed += step.advance
+
+				// the loop saved and waits for the next interval
+				fake.BlockUntil(1)
+
+				if got := store.saves.Load(); got != step.wantSaves {
+					t.Errorf("after %v: %d saves, want %d", elapsed, got, step.wantSaves)
+				}
+			}
+		})
+	}
+}
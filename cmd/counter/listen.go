@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// unixPrefix marks a -listen address as path of a Unix domain socket.
+const unixPrefix = "unix:"
+
+// listenNetwork splits a -listen address into the network and address
+// for net.Listen. Addresses with unixPrefix are Unix sockets, all others
+// are TCP, including bracketed IPv6 addresses such as [::1]:8080.
+func listenNetwork(addr string) (network, address string) {
+	path, ok := strings.CutPrefix(addr, unixPrefix)
+	if ok {
+		return "unix", path
+	}
+
+	return "tcp", addr
+}
+
+// listen listens on addr. An existing socket file is only removed if
+// connecting to it is refused, as it was left behind by a crashed
+// server. The lock file does not protect it: the socket may belong to a
+// server of another counter file. If a server accepts the connection,
+// listen fails with syscall.EADDRINUSE. The socket file is removed again
+// when the listener is closed.
+func listen(addr string) (net.Listener, error) {
+	network, address := listenNetwork(addr)
+
+	if network == "unix" {
+		err := removeStaleSocket(address)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return net.Listen(network, address)
+}
+
+// removeStaleSocket removes the socket file path if no server listens on
+// it anymore. Other files are left for net.Listen to fail on.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if fi.Mode().Type() != fs.ModeSocket {
+		return nil
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+
+		return fmt.Errorf("socket '%s' is served by another process: %w", path, syscall.EADDRINUSE)
+	}
+
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// httpClient returns the client reaching the server on listenAddr. For a
+// Unix socket every connection is dialed to the socket, whatever the
+// host of the URL.
+func httpClient() *http.Client {
+	network, address := listenNetwork(listenAddr)
+	if network != "unix" {
+		return http.DefaultClient
+	}
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+
+			return d.DialContext(ctx, network, address)
+		},
+	}
+
+	return &http.Client{Transport: transport}
+}
+
+// limitListener accepts at most cap(sem) connections at once, like
+// netutil.LimitListener. Further connections wait in the backlog of the
+// socket until an accepted one is closed.
+type limitListener struct {
+	net.Listener
+	sem       chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// limitConns returns ln limited to n concurrent connections, ln itself
+// if n is not positive.
+func limitConns(ln net.Listener, n int) net.Listener {
+	if n <= 0 {
+		return ln
+	}
+
+	return &limitListener{Listener: ln, sem: make(chan struct{}, n), done: make(chan struct{})}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	select {
+	case l.sem <- struct{}{}:
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+
+	c, err := l.Listener.Accept()
+	if err != nil {
+		<-l.sem
+
+		return nil, err
+	}
+
+	return &limitConn{Conn: c, release: func() { <-l.sem }}, nil
+}
+
+func (l *limitListener) Close() error {
+	err := l.Listener.Close()
+	l.closeOnce.Do(func() { close(l.done) })
+
+	return err
+}
+
+// limitConn frees its slot of a limitListener once it is closed.
+type limitConn struct {
+	net.Conn
+	releaseOnce sync.Once
+	release     func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.releaseOnce.Do(c.release)
+
+	return err
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/matbits/counter/pkg/lockfile"
+)
+
+// lockInfoResponse is the output of -lockinfo.
+type lockInfoResponse struct {
+	Path   string `json:"path"`
+	Locked bool   `json:"locked"`
+	// Pid is the process holding the lock, -1 if it is not held or the
+	// platform does not report it.
+	Pid int `json:"pid"`
+}
+
+// printLockInfo writes whether path is locked and by which process as
+// JSON to stdout. The lock state is only queried, the lock is never
+// taken.
+func printLockInfo(path string) error {
+	flock := lockfile.NewLockfile(path)
+
+	locked, err := flock.IsLocked()
+	if err != nil {
+		return err
+	}
+
+	pid := -1
+	if locked {
+		pid, err = flock.Owner()
+		if err != nil {
+			return err
+		}
+	}
+
+	return json.NewEncoder(os.Stdout).Encode(lockInfoResponse{Path: path, Locked: locked, Pid: pid})
+}
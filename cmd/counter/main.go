@@ -2,180 +2,510 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"log"
-	"net"
+	"log/slog"
+	"math"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"sync"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
-	"github.com/matbits/counter/pkg/fhandler"
+	"github.com/matbits/counter/pkg/clock"
+	"github.com/matbits/counter/pkg/counter"
+	"github.com/matbits/counter/pkg/counter/httpapi"
 	"github.com/matbits/counter/pkg/lockfile"
 )
 
 var (
-	fileName   string
-	listenAddr string
-	number     float64
-	lock       sync.RWMutex
+	configFile      string
+	fileName        string
+	storeKind       string
+	wal             bool
+	walCompact      time.Duration
+	backup          bool
+	memory          bool
+	maxConns        int
+	writeTimeout    time.Duration
+	snapshotEvery   time.Duration
+	initValue       string
+	lockPath        string
+	lockInfo        bool
+	lockWait        time.Duration
+	showVersion     bool
+	dumpFile        string
+	mkdir           bool
+	countersFile    string
+	historyFile     string
+	logFormat       string
+	listenAddr      string
+	tlsCert         string
+	tlsKey          string
+	authToken       string
+	authRead        bool
+	readOnly        bool
+	rateLimitRate   float64
+	rateLimitBurst  int
+	rateLimitPerIP  bool
+	shutdownTimeout time.Duration
+	flushInterval   time.Duration
+	latestCache     time.Duration
+	minNumber       int64
+	maxNumber       int64
+	step            int64
+	maxBodySize     int64
+
+	ctr *counter.Counter
+	// stats are the statistics of the handler, reported by dumpLoop.
+	stats *httpapi.Stats
+	// clk is the clock of all time based behavior of the server.
+	clk clock.Clock = clock.Real
 )
 
 func init() {
+	flag.StringVar(&configFile, "config", "", "path to a JSON or TOML config file, command line flags take precedence")
 	flag.StringVar(&fileName, "file", "counter.txt", "path to counter storage file")
-	flag.StringVar(&listenAddr, "listen", ":8080", "[ip]:port to listen")
+	flag.StringVar(&lockPath, "lockfile", "", "path to the lock file preventing concurrent instances, <file>.lock if empty")
+	flag.BoolVar(&mkdir, "mkdir", false, "create missing parent directories of -file and -lockfile")
+	flag.StringVar(&dumpFile, "dump-file", "", "path of the state dump written on SIGUSR1, <file>.dump.json if empty")
+	flag.DurationVar(&lockWait, "lock-wait", 0, "how long to wait for a running instance to release the lock, 0 fails at once")
+	flag.BoolVar(&showVersion, "version", false, "print the version as JSON and exit")
+	flag.BoolVar(&lockInfo, "lockinfo", false, "print whether the lock file is held and by which pid as JSON and exit")
+	flag.StringVar(&storeKind, "store", "file", "storage backend of the counter")
+	flag.BoolVar(&wal, "wal", false, "append every change to a write-ahead log instead of rewriting the file")
+	flag.BoolVar(&memory, "memory", false, "keep all counters in memory only, without any file or lock, they reset on restart")
+	flag.BoolVar(&backup, "backup", false, "keep the previous value in <file>.bak on every write and roll back to it if the file is corrupt")
+	flag.DurationVar(&walCompact, "wal-compact", time.Minute, "interval of compacting the write-ahead log, 0 only compacts at shutdown")
+	flag.StringVar(&initValue, "init-value", "", "value of a newly created counter file, $COUNTER_INIT or 0 if empty")
+	flag.StringVar(&countersFile, "counters", "counters.json", "path to named counters storage file")
+	flag.StringVar(&historyFile, "history", "", "path to a JSON lines file recording every increment, disabled if empty")
+	flag.StringVar(&logFormat, "log-format", "text", "log output format, text or json")
+	flag.StringVar(&listenAddr, "listen", ":8080", "[ip]:port to listen, or unix:path for a Unix socket")
+	flag.IntVar(&maxConns, "max-conns", 0, "largest number of connections served at once, further ones wait in the listen backlog, unlimited if 0")
+	flag.StringVar(&tlsCert, "tls-cert", "", "path to the TLS certificate, serves HTTPS if set")
+	flag.StringVar(&tlsKey, "tls-key", "", "path to the TLS private key")
+	flag.StringVar(&authToken, "auth-token", "", "bearer token required by mutating endpoints, disabled if empty")
+	flag.BoolVar(&authRead, "auth-read", false, "require the bearer token for reading endpoints as well")
+	flag.BoolVar(&readOnly, "readonly", false, "reject all changes with 403 and take a shared lock, so several read-only servers can share the file")
+	flag.Float64Var(&rateLimitRate, "rate", 0, "allowed /hostname requests per second, unlimited if 0")
+	flag.IntVar(&rateLimitBurst, "burst", 1, "number of /hostname requests allowed at once above -rate")
+	flag.BoolVar(&rateLimitPerIP, "rate-per-ip", false, "apply -rate per client IP instead of globally")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", time.Minute, "time to wait for in-flight requests on shutdown")
+	flag.DurationVar(&writeTimeout, "write-timeout", 10*time.Second, "time a write of the counter file may take before the change fails with 503, unlimited if 0")
+	flag.DurationVar(&snapshotEvery, "snapshot-interval", 0, "save the counter every interval if it changed, bounding the loss of a kill in write-behind mode, disabled if 0")
+	flag.DurationVar(&flushInterval, "flush-interval", 0, "persist the counter at most once per interval instead of on every change, disabled if 0")
+	flag.DurationVar(&latestCache, "latest-cache", 0, "max-age of /latest responses for caches, not cacheable if 0")
+	flag.Int64Var(&maxBodySize, "max-body", 1024, "largest request body in bytes accepted by mutating endpoints")
+	flag.Int64Var(&step, "step", 1, "amount /hostname adds to the counter")
+	flag.Int64Var(&minNumber, "min", math.MinInt64, "lowest value /hostname and /decrement may reach")
+	flag.Int64Var(&maxNumber, "max", math.MaxInt64, "highest value /hostname may reach")
 }
 
 func main() {
+	flag.Usage = usage
+
 	flag.Parse()
 
-	lockFile := filepath.Join(os.TempDir(), "counter.lock")
-	flock := lockfile.NewFcntlLockfile(lockFile)
+	// the command is the first argument after the leading flags, the
+	// flags following it are parsed as well
+	command := "serve"
+	if flag.NArg() > 0 {
+		command = flag.Arg(0)
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
+
+	// get, set and inc check their arguments themselves
+	if (command == "serve" || command == "verify") && flag.NArg() > 0 {
+		slog.Error("unexpected arguments", "command", command, "args", flag.Args())
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if showVersion {
+		err := printVersion()
+		if err != nil {
+			slog.Error("unable to print version", "error", err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	if configFile != "" {
+		err := loadConfig(configFile)
+		if err != nil {
+			slog.Error("unable to load config", "file", configFile, "error", err)
+			os.Exit(1)
+		}
+	}
 
-	err := flock.LockWrite()
+	logger, err := newLogger(logFormat)
 	if err != nil {
-		log.Printf("unable to get lock '%s': %s", lockFile, err)
+		slog.Error("invalid log format", "format", logFormat, "error", err)
 		os.Exit(1)
 	}
 
-	defer flock.Unlock()
+	slog.SetDefault(logger)
 
 	if listenAddr == "" || fileName == "" {
-		log.Println("invalid address or file")
+		slog.Error("invalid address or file", "listen", listenAddr, "file", fileName)
 		os.Exit(1)
 	}
 
-	err = createFile(fileName)
-	if err != nil {
-		log.Printf("unable to create file '%s': %s", fileName, err)
+	lockFile := lockPath
+	if lockFile == "" {
+		lockFile = fileName + ".lock"
+	}
+
+	if filepath.Clean(lockFile) == filepath.Clean(fileName) {
+		slog.Error("lock file must differ from the counter file", "file", lockFile)
 		os.Exit(1)
 	}
 
-	counterContent, err := os.ReadFile(fileName)
+	if lockInfo {
+		err := printLockInfo(lockFile)
+		if err != nil {
+			slog.Error("unable to query lock", "file", lockFile, "error", err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	for _, path := range []string{fileName, lockFile} {
+		if memory {
+			break
+		}
+
+		err = ensureDir(path, mkdir)
+		if err != nil {
+			slog.Error("invalid storage directory", "file", path, "error", err)
+			os.Exit(1)
+		}
+	}
+
+	switch command {
+	case "serve":
+		code := serve(lockFile)
+		if code != 0 {
+			os.Exit(code)
+		}
+	case "verify":
+		err = verify(lockFile)
+		if err != nil {
+			slog.Error("counter file is invalid", "file", fileName, "error", err)
+			os.Exit(1)
+		}
+	case "get", "set", "inc":
+		err = runCommand(command, flag.Args(), lockFile)
+		if err != nil {
+			slog.Error("unable to run command", "command", command, "error", err)
+			os.Exit(1)
+		}
+	default:
+		slog.Error("unknown command", "command", command)
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// serve runs the HTTP server until it is shut down by a signal and
+// returns the exit code. The lock file is released before it returns. In
+// memory mode no lock is taken, as there is no file to protect.
+func serve(lockFile string) int {
+	if !memory {
+		flock, ok := acquireLock(lockFile)
+		if !ok {
+			return 1
+		}
+
+		defer func() {
+			err := flock.Unlock()
+			if err != nil {
+				slog.Error("unable to release lock", "file", lockFile, "error", err)
+			}
+		}()
+	}
+
+	if (tlsCert == "") != (tlsKey == "") {
+		slog.Error("-tls-cert and -tls-key must be set together", "cert", tlsCert, "key", tlsKey)
+		return 1
+	}
+
+	start, err := initialValue()
 	if err != nil {
-		log.Printf("unable to read file '%s': %s", fileName, err)
-		os.Exit(1)
+		slog.Error("invalid init value", "error", err)
+		return 1
 	}
 
-	err = json.Unmarshal(counterContent, &number)
+	store, err := newStore(storeKind, start)
 	if err != nil {
-		log.Printf("unable to unmarshal counter: %s", err)
-		os.Exit(1)
+		slog.Error("invalid store", "store", storeKind, "error", err)
+		return 1
+	}
+
+	ctr, err = counter.New(store)
+	if err != nil {
+		slog.Error("unable to load counter", "store", storeKind, "file", fileName, "error", err)
+		return 1
+	}
+
+	ctr.Min = minNumber
+	ctr.Max = maxNumber
+	ctr.WriteBehind = flushInterval > 0
+	ctr.ReadOnly = readOnly
+	stats = httpapi.NewStats(clk.Now())
+
+	ctr.OnPersist = stats.RecordPersist
+	ctr.Clock = clk
+	ctr.SaveTimeout = writeTimeout
+
+	if historyFile != "" {
+		ctr.OnChange = (&httpapi.History{Path: historyFile, Clock: clk}).OnChange
 	}
 
-	http.HandleFunc("/hostname", hostname)
-	http.HandleFunc("/latest", latestCounter)
+	counters := &httpapi.NamedCounters{}
+	if !memory {
+		counters.Path = countersFile
+	}
+
+	err = counters.Load()
+	if err != nil {
+		slog.Error("unable to load counters", "file", countersFile, "error", err)
+		return 1
+	}
 
-	server := &http.Server{Addr: listenAddr}
+	handler := httpapi.NewHandler(ctr, httpapi.Options{
+		Step:        step,
+		AuthToken:   authToken,
+		AuthRead:    authRead,
+		RateLimit:   rateLimitRate,
+		RateBurst:   rateLimitBurst,
+		RatePerIP:   rateLimitPerIP,
+		LatestCache: latestCache,
+		MaxBodySize: maxBodySize,
+		Counters:    counters,
+		Stats:       stats,
+		Version:     buildVersion(),
+		Clock:       clk,
+	})
+
+	server := &http.Server{Addr: listenAddr, Handler: handler}
 
 	addr := server.Addr
 	if addr == "" {
 		addr = ":http"
 	}
 
-	ln, err := net.Listen("tcp", addr)
+	ln, err := listen(addr)
 	if err != nil {
-		log.Println(err.Error())
+		if errors.Is(err, syscall.EADDRINUSE) {
+			slog.Error("address already in use, is another server listening on it?", "listen", addr, "error", err)
+		} else {
+			slog.Error("unable to listen", "listen", addr, "error", err)
+		}
 
-		return
+		return 1
 	}
 
+	ln = limitConns(ln, maxConns)
+
 	defer ln.Close()
 
 	interChan := make(chan os.Signal, 2)
 	signal.Notify(interChan, os.Interrupt, syscall.SIGTERM) // subscribe to system signals
 
-	go shutdown(server, interChan)
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
 
-	log.Println("server running")
+	go reload(hupChan)
 
-	err = server.Serve(ln)
-	if err != nil {
-		if !errors.Is(err, http.ErrServerClosed) {
-			log.Printf("unable to handle: %s", err)
-			os.Exit(1)
+	if len(dumpSignals) > 0 {
+		dumpChan := make(chan os.Signal, 1)
+		signal.Notify(dumpChan, dumpSignals...)
+
+		// in memory mode no lock is held
+		heldLock := lockFile
+		if memory {
+			heldLock = ""
 		}
+
+		go dumpLoop(dumpChan, heldLock)
 	}
-}
 
-func latestCounter(w http.ResponseWriter, r *http.Request) {
-	lock.RLock()
-	defer lock.RUnlock()
+	done := make(chan struct{})
 
-	_, err := w.Write([]byte(fmt.Sprintf("%d", int(number))))
-	if err != nil {
-		log.Printf("unable to number: %s", err)
+	go shutdown(server, interChan, done)
+
+	if flushInterval > 0 {
+		go flushLoop(flushInterval)
+	}
+
+	if snapshotEvery > 0 {
+		go snapshotLoop(snapshotEvery)
 	}
-}
 
-func hostname(w http.ResponseWriter, r *http.Request) {
-	lock.Lock()
-	defer lock.Unlock()
+	if s, ok := store.(*counter.WALStore); ok && walCompact > 0 {
+		go compactLoop(s, walCompact)
+	}
 
-	number++
+	slog.Info("server running", "listen", ln.Addr().String())
 
-	out, err := json.Marshal(number)
+	if tlsCert != "" {
+		err = server.ServeTLS(ln, tlsCert, tlsKey)
+	} else {
+		err = server.Serve(ln)
+	}
 	if err != nil {
-		number--
+		if !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("unable to handle", "error", err)
+			return 1
+		}
+	}
 
-		log.Printf("unable to marshal counter: %s", err)
-		w.WriteHeader(http.StatusServiceUnavailable)
+	<-done
 
-		return
-	}
+	return 0
+}
 
-	err = fhandler.WriteAtomicTmpDir("counter", fileName, out, 0644)
+// acquireLock takes the lock of lockFile for the server: shared in
+// read-only mode, else exclusive, waiting up to lockWait. Failures are
+// logged and reported as false.
+func acquireLock(lockFile string) (*lockfile.Lockfile, bool) {
+	flock := lockfile.NewLockfile(lockFile)
+
+	begin := clk.Now()
+
+	var err error
+	switch {
+	case readOnly:
+		// wait for a writing instance to finish instead of failing
+		err = flock.LockReadB()
+	case lockWait > 0:
+		err = flock.LockWriteTimeout(lockWait)
+	default:
+		err = flock.LockWrite()
+	}
 	if err != nil {
-		number--
-
-		log.Printf("unable to write file '%s': %s", fileName, err)
-		w.WriteHeader(http.StatusServiceUnavailable)
+		var lockErr *lockfile.LockError
+		if errors.Is(err, lockfile.ErrLockTimeout) {
+			slog.Error("timed out waiting for lock", "file", lockFile, "waited", clk.Now().Sub(begin))
+		} else if errors.As(err, &lockErr) && lockErr.Pid > 0 {
+			slog.Error("another instance is running, lock is held", "file", lockFile, "pid", lockErr.Pid, "error", err)
+		} else {
+			slog.Error("unable to get lock", "file", lockFile, "error", err)
+		}
 
-		return
+		return nil, false
 	}
 
-	_, err = w.Write([]byte(fmt.Sprintf("%d", int(number))))
-	if err != nil {
-		log.Printf("unable to number: %s", err)
+	if lockWait > 0 {
+		slog.Info("acquired lock", "file", lockFile, "waited", clk.Now().Sub(begin))
 	}
+
+	return flock, true
 }
 
-func createFile(fileName string) error {
-	_, err := os.Stat(fileName)
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			return initFile(fileName)
+// ensureDir checks that the parent directory of path exists. With create
+// set, a missing directory is created instead.
+func ensureDir(path string, create bool) error {
+	dir := filepath.Dir(path)
+
+	fi, err := os.Stat(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		if create {
+			return os.MkdirAll(dir, 0755)
 		}
 
+		return fmt.Errorf("directory '%s' does not exist, create it or use -mkdir", dir)
+	}
+
+	if err != nil {
 		return err
 	}
 
+	if !fi.IsDir() {
+		return fmt.Errorf("'%s' is not a directory", dir)
+	}
+
 	return nil
 }
 
-func initFile(fileName string) error {
-	out, err := json.Marshal(number)
-	if err != nil {
-		return err
+// initialValue returns the value a new counter file starts at, taken
+// from initValue or the COUNTER_INIT environment variable.
+func initialValue() (int64, error) {
+	raw := initValue
+	if raw == "" {
+		raw = os.Getenv("COUNTER_INIT")
+	}
+
+	if raw == "" {
+		return 0, nil
 	}
 
-	return fhandler.WriteAtomicTmpDir("counter", fileName, out, 0644)
+	return parseInt(raw)
 }
 
-func shutdown(server *http.Server, c chan os.Signal) {
+// parseInt parses raw as a base 10 integer.
+func parseInt(raw string) (int64, error) {
+	return strconv.ParseInt(strings.TrimSpace(raw), 10, 64)
+}
+
+// newLogger returns a logger writing to stderr in the given format.
+func newLogger(format string) (*slog.Logger, error) {
+	switch format {
+	case "text":
+		// the default logger keeps the timestamp prefix of the log package
+		return slog.Default(), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, nil)), nil
+	default:
+		return nil, fmt.Errorf("unknown format '%s'", format)
+	}
+}
+
+// reload replaces the counter with the stored value whenever c receives
+// a signal. If the store cannot be read, the current value is kept.
+func reload(c chan os.Signal) {
+	for range c {
+		old := ctr.Value()
+
+		value, err := ctr.Reload()
+		if err != nil {
+			slog.Error("unable to reload counter, keeping current value", "file", fileName, "value", value, "error", err)
+
+			continue
+		}
+
+		slog.Info("reloaded counter", "file", fileName, "old", old, "value", value)
+	}
+}
+
+// shutdown stops the server once c receives a signal and waits up to
+// shutdownTimeout for in-flight requests. Afterwards it closes the
+// counter, which flushes it in write-behind mode and rejects late
+// changes, so none is lost by the exit. done is closed when the server
+// may exit.
+func shutdown(server *http.Server, c chan os.Signal, done chan struct{}) {
 	<-c
 
-	ctx, cancal := context.WithTimeout(context.Background(), time.Minute)
+	defer close(done)
+
+	ctx, cancal := context.WithTimeout(context.Background(), shutdownTimeout)
 	defer cancal()
 
 	err := server.Shutdown(ctx)
 	if err != nil {
-		log.Printf("unable to shutdown server: %s", err)
+		slog.Error("unable to shutdown server", "pending", stats.InFlight.Load(), "error", err)
+	}
+
+	err = ctr.Close()
+	if err != nil {
+		slog.Error("unable to flush counter", "file", fileName, "error", err)
 	}
 }
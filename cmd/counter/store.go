@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/matbits/counter/pkg/counter"
+)
+
+// newStore returns the Store selected by kind. A new store starts at
+// start. With -wal the file store keeps a write-ahead log, with -memory
+// kind is ignored and the counter is only kept in memory. In read-only
+// mode the file is never written.
+func newStore(kind string, start int64) (counter.Store, error) {
+	if memory {
+		return &counter.MemoryStore{Init: start}, nil
+	}
+
+	switch kind {
+	case "file":
+		if wal {
+			return &counter.WALStore{Path: fileName, Init: start, ReadOnly: readOnly}, nil
+		}
+
+		return &counter.FileStore{Path: fileName, Init: start, Backup: backup, ReadOnly: readOnly}, nil
+	default:
+		return nil, fmt.Errorf("unknown store '%s'", kind)
+	}
+}
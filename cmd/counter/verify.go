@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/matbits/counter/pkg/lockfile"
+)
+
+// verifier is a Store that can check its content without writing.
+type verifier interface {
+	Verify() (int64, error)
+}
+
+// verify checks that fileName holds a valid counter and prints its value
+// and mode. It takes a read lock if possible, a running server holding
+// the write lock does not prevent the check as the file is only ever
+// replaced atomically.
+func verify(lockFile string) error {
+	if memory {
+		return errors.New("there is no counter file in memory mode")
+	}
+
+	flock := lockfile.NewLockfile(lockFile)
+
+	locked, err := flock.TryLockRead()
+	if err != nil {
+		return err
+	}
+
+	if locked {
+		defer flock.Unlock()
+	} else {
+		slog.Info("lock is held by a server, reading without lock", "file", lockFile)
+	}
+
+	fi, err := os.Stat(fileName)
+	if err != nil {
+		return err
+	}
+
+	store, err := newStore(storeKind, 0)
+	if err != nil {
+		return err
+	}
+
+	v, ok := store.(verifier)
+	if !ok {
+		return fmt.Errorf("store '%s' cannot be verified", storeKind)
+	}
+
+	value, err := v.Verify()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: value %d, mode %s\n", fileName, value, fi.Mode())
+
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"runtime"
+	"runtime/debug"
+)
+
+// version and buildTime are set when building, e.g. with
+// -ldflags "-X main.version=1.2.0 -X main.buildTime=2024-05-01T12:00:00Z".
+// Without buildTime the commit time recorded by the go tool is reported.
+var (
+	version   = "dev"
+	buildTime string
+)
+
+// versionResponse is the output of /version and -version.
+type versionResponse struct {
+	Version   string `json:"version"`
+	GoVersion string `json:"go_version"`
+	Revision  string `json:"revision,omitempty"`
+	BuildTime string `json:"build_time,omitempty"`
+}
+
+// buildVersion returns the version of the running binary.
+func buildVersion() versionResponse {
+	resp := versionResponse{Version: version, GoVersion: runtime.Version(), BuildTime: buildTime}
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return resp
+	}
+
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			resp.Revision = setting.Value
+		case "vcs.time":
+			if resp.BuildTime == "" {
+				resp.BuildTime = setting.Value
+			}
+		}
+	}
+
+	return resp
+}
+
+// printVersion writes the version of the binary as JSON to stdout.
+func printVersion() error {
+	return json.NewEncoder(os.Stdout).Encode(buildVersion())
+}
@@ -0,0 +1,77 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := NewFake(start)
+
+	short := f.After(time.Second)
+	long := f.After(time.Minute)
+	now := f.After(0)
+
+	select {
+	case got := <-now:
+		if !got.Equal(start) {
+			t.Errorf("After(0) fired with %v, want %v", got, start)
+		}
+	default:
+		t.Error("After(0) did not fire at once")
+	}
+
+	if n := f.Waiters(); n != 2 {
+		t.Errorf("Waiters() = %d, want 2", n)
+	}
+
+	f.Advance(time.Second - 1)
+
+	select {
+	case <-short:
+		t.Fatal("After(1s) fired early")
+	default:
+	}
+
+	f.Advance(1)
+
+	select {
+	case got := <-short:
+		if want := start.Add(time.Second); !got.Equal(want) {
+			t.Errorf("After(1s) fired with %v, want %v", got, want)
+		}
+	default:
+		t.Fatal("After(1s) did not fire")
+	}
+
+	if n := f.Waiters(); n != 1 {
+		t.Errorf("Waiters() = %d, want 1", n)
+	}
+
+	f.Advance(time.Hour)
+
+	select {
+	case <-long:
+	default:
+		t.Fatal("After(1m) did not fire")
+	}
+
+	if got, want := f.Now(), start.Add(time.Hour+time.Second); !got.Equal(want) {
+		t.Errorf("Now() = %v, want %v", got, want)
+	}
+}
+
+func TestFakeBlockUntil(t *testing.T) {
+	f := NewFake(time.Now())
+	done := make(chan struct{})
+
+	go func() {
+		<-f.After(time.Second)
+		close(done)
+	}()
+
+	f.BlockUntil(1)
+	f.Advance(time.Second)
+	<-done
+}
@@ -0,0 +1,415 @@
+// Package counter implements an int64 counter persisted in a Store.
+package counter
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/matbits/counter/pkg/clock"
+	"github.com/matbits/counter/pkg/counter/internal/overflow"
+)
+
+var (
+	ErrOverflow   = errors.New("counter overflow")
+	ErrOutOfRange = errors.New("counter out of range")
+	ErrClosed     = errors.New("counter closed")
+	ErrReadOnly   = errors.New("counter is read-only")
+	ErrTimeout    = errors.New("counter save timed out")
+	ErrMismatch   = errors.New("counter does not hold the expected value")
+)
+
+// Counter is an int64 counter persisted in a Store. It is safe for
+// concurrent use. Every change is saved before it becomes visible; if
+// the store fails, the previous value is kept.
+type Counter struct {
+	// Min and Max bound the values Add may reach. They must be set
+	// before the counter is used.
+	Min int64
+	Max int64
+	// WriteBehind only marks changes as dirty instead of saving them,
+	// they are persisted by the next Flush or Close.
+	WriteBehind bool
+	// ReadOnly rejects all changes with ErrReadOnly and never writes to
+	// the store.
+	ReadOnly bool
+	// OnPersist is called with the duration and result of every save to
+	// the store while the counter is locked. It may be nil.
+	OnPersist func(d time.Duration, err error)
+	// OnChange is called with the context of the change and the new value
+	// after every change, while the counter is still locked, so the calls
+	// are ordered like the changes. It may be nil.
+	OnChange func(ctx context.Context, value int64)
+	// Clock times the saves and their timeouts. clock.Real is used if
+	// nil.
+	Clock clock.Clock
+	// SaveTimeout bounds every save to the store. A save taking longer
+	// fails with ErrTimeout and the value is kept, so a hanging store
+	// does not block the counter. The save keeps running in the
+	// background; until it returns, all saves fail at once with
+	// ErrTimeout. If it still reaches the store, the current value is
+	// saved again, so the store does not keep a value that was never
+	// acknowledged. Saves are not bounded if zero.
+	SaveTimeout time.Duration
+
+	store   Store
+	mu      sync.RWMutex
+	value   int64
+	changed time.Time
+	dirty   bool
+	closed  bool
+	// saving holds a token while a bounded save runs.
+	saving chan struct{}
+	// snapshot is the value of the last Snapshot, or the loaded one.
+	snapshot int64
+	// lastPersist is the time of the last successful save in
+	// nanoseconds since the Unix epoch, zero if there was none.
+	lastPersist atomic.Int64
+}
+
+// New returns a counter holding the value loaded from store.
+func New(store Store) (*Counter, error) {
+	value, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Counter{Min: math.MinInt64, Max: math.MaxInt64, store: store, saving: make(chan struct{}, 1), value: value, snapshot: value}, nil
+}
+
+// Value returns the current value.
+func (c *Counter) Value() int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.value
+}
+
+// ValueChanged returns the current value and the time of its last change,
+// the zero time if it did not change since New.
+func (c *Counter) ValueChanged() (int64, time.Time) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.value, c.changed
+}
+
+// Increment adds one to the counter and returns the new value.
+func (c *Counter) Increment() (int64, error) {
+	return c.Add(1)
+}
+
+// Decrement subtracts one from the counter and returns the new value.
+func (c *Counter) Decrement() (int64, error) {
+	return c.Add(-1)
+}
+
+// Add adds delta to the counter and returns the new value. If the sum
+// overflows or leaves [Min, Max], the counter is unchanged and the
+// current value is returned with ErrOverflow or ErrOutOfRange.
+func (c *Counter) Add(delta int64) (int64, error) {
+	return c.AddContext(context.Background(), delta)
+}
+
+// AddContext is Add with ctx passed to OnChange.
+func (c *Counter) AddContext(ctx context.Context, delta int64) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.addLocked(ctx, delta)
+}
+
+// CompareAndAdd is Add, but only changes the counter if it holds old.
+// Otherwise the current value is returned with ErrMismatch.
+func (c *Counter) CompareAndAdd(old, delta int64) (int64, error) {
+	return c.CompareAndAddContext(context.Background(), old, delta)
+}
+
+// CompareAndAddContext is CompareAndAdd with ctx passed to OnChange.
+func (c *Counter) CompareAndAddContext(ctx context.Context, old, delta int64) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.value != old {
+		return c.value, ErrMismatch
+	}
+
+	return c.addLocked(ctx, delta)
+}
+
+// addLocked implements Add. The caller must hold the write lock.
+func (c *Counter) addLocked(ctx context.Context, delta int64) (int64, error) {
+	sum, ok := overflow.Add(c.value, delta)
+	if !ok {
+		return c.value, ErrOverflow
+	}
+
+	if sum > c.Max || sum < c.Min {
+		return c.value, ErrOutOfRange
+	}
+
+	err := c.setLocked(ctx, sum)
+	if err != nil {
+		return c.value, err
+	}
+
+	return sum, nil
+}
+
+// Set replaces the value of the counter.
+func (c *Counter) Set(value int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.setLocked(context.Background(), value)
+}
+
+// Reload replaces the value with the one in the store and returns it.
+// If the store cannot be read, the current value is kept. Unflushed
+// changes are discarded.
+func (c *Counter) Reload() (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	value, err := c.store.Load()
+	if err != nil {
+		return c.value, err
+	}
+
+	c.value = value
+	c.dirty = false
+	c.snapshot = value
+
+	return value, nil
+}
+
+// Flush saves the value if it changed since the last save. A failed save
+// is retried by the next Flush.
+func (c *Counter) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.flushLocked()
+}
+
+// Snapshot saves the value unless it is unchanged since the last
+// Snapshot, even if it was saved in between. Unlike Flush it does not
+// depend on the dirty state, so periodic snapshots bound the loss of an
+// unclean exit independent of the flushing. A read-only or closed counter
+// is not saved.
+func (c *Counter) Snapshot() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ReadOnly || c.closed || c.value == c.snapshot {
+		return nil
+	}
+
+	err := c.persist(c.value)
+	if err != nil {
+		return err
+	}
+
+	c.snapshot = c.value
+	c.dirty = false
+
+	return nil
+}
+
+// Check reports whether the store can still be read and written. It
+// never changes the store: nothing is created, migrated or rolled back.
+// A read-only counter only checks the read, a store not implementing
+// Checker is always healthy.
+func (c *Counter) Check() error {
+	checker, ok := c.store.(Checker)
+	if !ok {
+		return nil
+	}
+
+	return checker.Check(!c.ReadOnly)
+}
+
+// LastPersist returns the time of the last successful save, the zero
+// time if there was none.
+func (c *Counter) LastPersist() time.Time {
+	nanos := c.lastPersist.Load()
+	if nanos == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, nanos)
+}
+
+// Close flushes the value and rejects all further changes with
+// ErrClosed, so no change after Close can be lost. A store implementing
+// io.Closer is closed as well.
+func (c *Counter) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil
+	}
+
+	c.closed = true
+
+	err := c.flushLocked()
+
+	if closer, ok := c.store.(io.Closer); ok {
+		cerr := closer.Close()
+		if err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+// setLocked sets the value and saves it. In write-behind mode it only
+// marks the value as dirty. OnChange is called with ctx on success. The
+// caller must hold the write lock.
+func (c *Counter) setLocked(ctx context.Context, value int64) error {
+	if c.closed {
+		return ErrClosed
+	}
+
+	if c.ReadOnly {
+		return ErrReadOnly
+	}
+
+	if c.WriteBehind {
+		c.dirty = true
+	} else {
+		err := c.persist(value)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.value = value
+	c.changed = clock.OrReal(c.Clock).Now()
+
+	if c.OnChange != nil {
+		c.OnChange(ctx, value)
+	}
+
+	return nil
+}
+
+// flushLocked saves the value if it is dirty. The caller must hold the
+// write lock.
+func (c *Counter) flushLocked() error {
+	if !c.dirty {
+		return nil
+	}
+
+	err := c.persist(c.value)
+	if err != nil {
+		return err
+	}
+
+	c.dirty = false
+
+	return nil
+}
+
+// persist saves value to the store and records the time of the save.
+func (c *Counter) persist(value int64) error {
+	clk := clock.OrReal(c.Clock)
+	start := clk.Now()
+
+	err := c.save(value)
+	now := clk.Now()
+
+	if c.OnPersist != nil {
+		c.OnPersist(now.Sub(start), err)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	c.lastPersist.Store(now.UnixNano())
+
+	return nil
+}
+
+// save saves value to the store, bounded by SaveTimeout if set.
+func (c *Counter) save(value int64) error {
+	if c.SaveTimeout <= 0 {
+		return c.store.Save(value)
+	}
+
+	// a save that timed out may still be running, never save concurrently
+	// and never wait for it while holding the lock
+	select {
+	case c.saving <- struct{}{}:
+	default:
+		return ErrTimeout
+	}
+
+	timeout := clock.OrReal(c.Clock).After(c.SaveTimeout)
+
+	// state is saveDone once the save returned in time, or saveAbandoned
+	// once it timed out
+	var state atomic.Int32
+
+	done := make(chan error, 1)
+
+	go func() {
+		defer func() { <-c.saving }()
+
+		err := c.store.Save(value)
+		if state.CompareAndSwap(savePending, saveDone) {
+			done <- err
+
+			return
+		}
+
+		if err == nil {
+			c.restore(value)
+		}
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-timeout:
+		if state.CompareAndSwap(savePending, saveAbandoned) {
+			return ErrTimeout
+		}
+
+		// the save returned in the meantime
+		return <-done
+	}
+}
+
+// States of a save bounded by SaveTimeout.
+const (
+	savePending = iota
+	saveDone
+	saveAbandoned
+)
+
+// restore saves the current value again after a save of late, which
+// timed out, still reached the store. It must be called while the saving
+// token is held, so no other save runs and every later change is saved
+// after it.
+func (c *Counter) restore(late int64) {
+	current := c.Value()
+	if current == late {
+		return
+	}
+
+	slog.Warn("timed out save reached the store, saving the current value again", "saved", late, "value", current)
+
+	err := c.store.Save(current)
+	if err != nil {
+		slog.Error("unable to restore the counter after a timed out save", "saved", late, "value", current, "error", err)
+	}
+}
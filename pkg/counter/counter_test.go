@@ -0,0 +1,232 @@
+package counter
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matbits/counter/pkg/clock"
+)
+
+// blockingStore is a Store whose Save blocks until release is closed.
+// The saved values are sent to saved if it is not nil.
+type blockingStore struct {
+	release chan struct{}
+	saved   chan int64
+}
+
+func (s *blockingStore) Load() (int64, error) {
+	return 0, nil
+}
+
+func (s *blockingStore) Save(value int64) error {
+	<-s.release
+
+	if s.saved != nil {
+		s.saved <- value
+	}
+
+	return nil
+}
+
+func TestCounterSaveTimeout(t *testing.T) {
+	store := &blockingStore{release: make(chan struct{})}
+	defer close(store.release)
+
+	c, err := New(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clk := clock.NewFake(time.Now())
+	c.Clock = clk
+	c.SaveTimeout = time.Second
+
+	type result struct {
+		value int64
+		err   error
+	}
+
+	done := make(chan result, 1)
+
+	go func() {
+		value, err := c.Add(1)
+		done <- result{value, err}
+	}()
+
+	clk.BlockUntil(1)
+	clk.Advance(time.Second - 1)
+
+	select {
+	case r := <-done:
+		t.Fatalf("Add(1) returned %d, %v before the timeout", r.value, r.err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	clk.Advance(1)
+
+	r := <-done
+	if !errors.Is(r.err, ErrTimeout) || r.value != 0 {
+		t.Fatalf("Add(1) = %d, %v, want 0, %v", r.value, r.err, ErrTimeout)
+	}
+
+	// the hung save is still running, further saves fail at once instead
+	// of waiting for it, the clock is not advanced anymore
+	for range 5 {
+		_, err = c.Add(1)
+		if !errors.Is(err, ErrTimeout) {
+			t.Fatalf("Add(1) with a hung save = %v, want %v", err, ErrTimeout)
+		}
+	}
+
+	if got := c.Value(); got != 0 {
+		t.Errorf("Value() = %d, want 0", got)
+	}
+}
+
+func TestCounterLateSave(t *testing.T) {
+	store := &blockingStore{release: make(chan struct{}), saved: make(chan int64, 3)}
+
+	c, err := New(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clk := clock.NewFake(time.Now())
+	c.Clock = clk
+	c.SaveTimeout = time.Second
+
+	done := make(chan error, 1)
+
+	go func() {
+		_, err := c.Add(1)
+		done <- err
+	}()
+
+	clk.BlockUntil(1)
+	clk.Advance(time.Second)
+
+	err = <-done
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("Add(1) = %v, want %v", err, ErrTimeout)
+	}
+
+	// the timed out save reaches the store, the unchanged value follows
+	close(store.release)
+
+	for _, want := range []int64{1, 0} {
+		select {
+		case got := <-store.saved:
+			if got != want {
+				t.Fatalf("store saved %d, want %d", got, want)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("store did not save %d", want)
+		}
+	}
+
+	// once the late save returned, saves succeed again
+	deadline := time.Now().Add(10 * time.Second)
+
+	for {
+		_, err = c.Add(1)
+		if !errors.Is(err, ErrTimeout) || time.Now().After(deadline) {
+			break
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	if err != nil {
+		t.Fatalf("Add(1) after the late save = %v, want nil", err)
+	}
+
+	if got := <-store.saved; got != 1 {
+		t.Errorf("store saved %d, want 1", got)
+	}
+}
+
+func TestCounterOnChangeOrder(t *testing.T) {
+	c, err := New(&MemoryStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// OnChange runs under the counter lock, so it needs no lock of its own
+	var changes []int64
+	c.OnChange = func(_ context.Context, value int64) {
+		changes = append(changes, value)
+	}
+
+	var wg sync.WaitGroup
+
+	for range 8 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for range 100 {
+				c.Add(1)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if len(changes) != 800 {
+		t.Fatalf("got %d changes, want 800", len(changes))
+	}
+
+	for i, value := range changes {
+		if value != int64(i+1) {
+			t.Fatalf("change %d has value %d, want %d", i, value, i+1)
+		}
+	}
+}
+
+func TestCounterAddBounds(t *testing.T) {
+	tests := []struct {
+		name      string
+		init      int64
+		min, max  int64
+		delta     int64
+		want      int64
+		wantErr   error
+		wantSaved int64
+	}{
+		{name: "up to max", init: 9, min: math.MinInt64, max: 10, delta: 1, want: 10, wantSaved: 10},
+		{name: "above max", init: 10, min: math.MinInt64, max: 10, delta: 1, want: 10, wantErr: ErrOutOfRange, wantSaved: 10},
+		{name: "jump above max", init: 5, min: math.MinInt64, max: 10, delta: 6, want: 5, wantErr: ErrOutOfRange, wantSaved: 5},
+		{name: "down to min", init: 1, min: 0, max: math.MaxInt64, delta: -1, want: 0, wantSaved: 0},
+		{name: "below min", init: 0, min: 0, max: math.MaxInt64, delta: -1, want: 0, wantErr: ErrOutOfRange, wantSaved: 0},
+		{name: "up to MaxInt64", init: math.MaxInt64 - 1, min: math.MinInt64, max: math.MaxInt64, delta: 1, want: math.MaxInt64, wantSaved: math.MaxInt64},
+		{name: "overflow", init: math.MaxInt64, min: math.MinInt64, max: math.MaxInt64, delta: 1, want: math.MaxInt64, wantErr: ErrOverflow, wantSaved: math.MaxInt64},
+		{name: "underflow", init: math.MinInt64, min: math.MinInt64, max: math.MaxInt64, delta: -1, want: math.MinInt64, wantErr: ErrOverflow, wantSaved: math.MinInt64},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &MemoryStore{Init: tt.init}
+
+			c, err := New(store)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c.Min, c.Max = tt.min, tt.max
+
+			got, err := c.Add(tt.delta)
+			if got != tt.want || !errors.Is(err, tt.wantErr) {
+				t.Errorf("Add(%d) = %d, %v, want %d, %v", tt.delta, got, err, tt.want, tt.wantErr)
+			}
+
+			if saved, _ := store.Load(); saved != tt.wantSaved {
+				t.Errorf("saved %d, want %d", saved, tt.wantSaved)
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package httpapi
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// requireToken rejects requests without a valid bearer token with 401.
+// Every request is accepted if AuthToken is empty.
+func (h *handler) requireToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if h.opts.AuthToken != "" && !validToken(r, h.opts.AuthToken) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// requireReadToken is requireToken for read-only endpoints, which are
+// only protected if AuthRead is set.
+func (h *handler) requireReadToken(next http.HandlerFunc) http.HandlerFunc {
+	if !h.opts.AuthRead {
+		return next
+	}
+
+	return h.requireToken(next)
+}
+
+// validToken reports whether r carries authToken as bearer token. The
+// tokens are compared in constant time.
+func validToken(r *http.Request, authToken string) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(authToken)) == 1
+}
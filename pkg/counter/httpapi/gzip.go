@@ -0,0 +1,117 @@
+package httpapi
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// minGzipSize is the body size below which responses are sent
+// uncompressed, as the gzip overhead outweighs the savings.
+const minGzipSize = 256
+
+// gzipWriter buffers a response so compressResponses can decide on
+// compression once the full body size is known.
+type gzipWriter struct {
+	http.ResponseWriter
+	status int
+	buf    bytes.Buffer
+}
+
+func (w *gzipWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *gzipWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	return w.buf.Write(p)
+}
+
+// compressResponses gzips response bodies of at least minGzipSize bytes
+// for clients sending Accept-Encoding: gzip. The responses are buffered,
+// which is fine for the small bodies of this server.
+func compressResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		if !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		gw := &gzipWriter{ResponseWriter: w}
+		next.ServeHTTP(gw, r)
+
+		if gw.status == 0 {
+			gw.status = http.StatusOK
+		}
+
+		if gw.buf.Len() < minGzipSize || w.Header().Get("Content-Encoding") != "" {
+			w.WriteHeader(gw.status)
+
+			_, err := w.Write(gw.buf.Bytes())
+			if err != nil {
+				requestLogger(r).Error("unable to write response", "error", err)
+			}
+
+			return
+		}
+
+		var out bytes.Buffer
+
+		zw := gzip.NewWriter(&out)
+
+		_, err := zw.Write(gw.buf.Bytes())
+		if err == nil {
+			err = zw.Close()
+		}
+		if err != nil {
+			requestLogger(r).Error("unable to compress response", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+
+			return
+		}
+
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", strconv.Itoa(out.Len()))
+		w.WriteHeader(gw.status)
+
+		_, err = w.Write(out.Bytes())
+		if err != nil {
+			requestLogger(r).Error("unable to write response", "error", err)
+		}
+	})
+}
+
+// acceptsGzip reports whether the Accept-Encoding header of r lists gzip
+// without a zero quality.
+func acceptsGzip(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(accept, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			if strings.TrimSpace(name) != "gzip" {
+				continue
+			}
+
+			q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+			if ok {
+				weight, err := strconv.ParseFloat(q, 64)
+				if err == nil && weight == 0 {
+					return false
+				}
+			}
+
+			return true
+		}
+	}
+
+	return false
+}
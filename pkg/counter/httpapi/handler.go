@@ -0,0 +1,368 @@
+// Package httpapi serves a counter.Counter over HTTP.
+package httpapi
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/matbits/counter/pkg/clock"
+	"github.com/matbits/counter/pkg/counter"
+)
+
+// Options configures the handler returned by NewHandler. The zero value
+// serves the counter without authentication and limits.
+type Options struct {
+	// Step is the amount /hostname and /counters/{name}/increment add,
+	// one if zero.
+	Step int64
+	// AuthToken is the bearer token required by mutating endpoints,
+	// they are open if it is empty. With AuthRead set, it is required by
+	// the reading endpoints as well.
+	AuthToken string
+	AuthRead  bool
+	// RateLimit is the number of /hostname requests allowed per second,
+	// with RateBurst requests at once, per client IP with RatePerIP.
+	// Requests are not limited if it is zero.
+	RateLimit float64
+	RateBurst int
+	RatePerIP bool
+	// LatestCache is the max-age of /latest responses, they are not
+	// cacheable if zero.
+	LatestCache time.Duration
+	// MaxBodySize is the largest request body in bytes accepted by
+	// mutating endpoints, bodies are not limited if zero.
+	MaxBodySize int64
+	// Counters are the counters of /counters/{name}. They are kept in
+	// memory only if nil.
+	Counters *NamedCounters
+	// Stats collects the statistics of /stats and /metrics. A new one is
+	// started if nil.
+	Stats *Stats
+	// Version is written as JSON by GET /version, which is not served
+	// if it is nil.
+	Version any
+	// Clock is used for rate limiting and the statistics. clock.Real is
+	// used if nil.
+	Clock clock.Clock
+}
+
+// handler serves the endpoints of a counter.
+type handler struct {
+	ctr      *counter.Counter
+	opts     Options
+	clk      clock.Clock
+	limiter  *limiter
+	counters *NamedCounters
+	stats    *Stats
+}
+
+// NewHandler returns the handler of the endpoints of c: the endpoints on
+// their own mux, wrapped in the handler wide middleware. It can be
+// mounted under a prefix with http.StripPrefix. Changes are rejected with
+// 403 if c is read-only.
+func NewHandler(c *counter.Counter, opts Options) http.Handler {
+	h := &handler{ctr: c, opts: opts, clk: clock.OrReal(opts.Clock), counters: opts.Counters, stats: opts.Stats}
+
+	if h.opts.Step == 0 {
+		h.opts.Step = 1
+	}
+
+	if h.counters == nil {
+		h.counters = &NamedCounters{}
+	}
+
+	if h.stats == nil {
+		h.stats = NewStats(h.clk.Now())
+	}
+
+	if opts.RateLimit > 0 {
+		h.limiter = newLimiter(opts.RateLimit, opts.RateBurst, opts.RatePerIP)
+	}
+
+	return h.trackInFlight(withRequestID(compressResponses(h.newMux())))
+}
+
+// newMux returns a mux with all counter endpoints and their per endpoint
+// middleware.
+func (h *handler) newMux() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/hostname", h.requireToken(h.rejectReadOnly(h.rateLimit(h.limitBody(h.hostname)))))
+	mux.HandleFunc("/latest", h.requireReadToken(h.latestCounter))
+	mux.HandleFunc("/reset", h.requireToken(h.rejectReadOnly(h.limitBody(h.resetCounter))))
+	mux.HandleFunc("/set", h.requireToken(h.rejectReadOnly(h.limitBody(h.setCounter))))
+	mux.HandleFunc("/decrement", h.requireToken(h.rejectReadOnly(h.limitBody(h.decrement))))
+	mux.HandleFunc("/metrics", h.requireReadToken(h.metrics))
+	mux.HandleFunc("/healthz", h.healthz)
+	mux.HandleFunc("/stats", h.requireReadToken(h.statsHandler))
+	mux.HandleFunc("GET /counters/{name}", h.requireReadToken(h.namedCounter))
+	mux.HandleFunc("/counters/{name}/increment", h.requireToken(h.rejectReadOnly(h.limitBody(h.incrementNamed))))
+
+	if h.opts.Version != nil {
+		mux.HandleFunc("GET /version", h.version)
+	}
+
+	return mux
+}
+
+func (h *handler) latestCounter(w http.ResponseWriter, r *http.Request) {
+	h.stats.LatestRequests.Add(1)
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	if h.opts.LatestCache > 0 {
+		w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(h.opts.LatestCache.Seconds())))
+	} else {
+		w.Header().Set("Cache-Control", "no-store")
+	}
+
+	if r.URL.Query().Get("meta") == "1" {
+		value, changed := h.ctr.ValueChanged()
+		if changed.IsZero() {
+			changed = h.stats.Start
+		}
+
+		writeJSON(w, r, http.StatusOK, latestMeta{Value: value, AgeSeconds: h.clk.Now().Sub(changed).Seconds()})
+
+		return
+	}
+
+	writeValue(w, r, http.StatusOK, h.ctr.Value())
+}
+
+// latestMeta is the body of /latest?meta=1.
+type latestMeta struct {
+	Value int64 `json:"value"`
+	// AgeSeconds is the time since the last change, or since the start
+	// if the counter did not change yet.
+	AgeSeconds float64 `json:"age_seconds"`
+}
+
+func (h *handler) hostname(w http.ResponseWriter, r *http.Request) {
+	h.stats.HostnameRequests.Add(1)
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	by := h.opts.Step
+
+	if raw := r.URL.Query().Get("by"); raw != "" {
+		var err error
+
+		by, err = parseInt(raw)
+		if err != nil {
+			requestLogger(r).Warn("invalid step", "error", err)
+			w.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+	}
+
+	// the history line is appended by History under the counter lock
+	ctx := withHistory(r)
+
+	var value int64
+	var err error
+
+	// If-Match turns the increment into a compare-and-increment
+	if match := r.Header.Get("If-Match"); match != "" && match != "*" {
+		expected, perr := parseInt(strings.Trim(match, `"`))
+		if perr != nil {
+			requestLogger(r).Warn("invalid If-Match", "error", perr)
+			w.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+
+		value, err = h.ctr.CompareAndAddContext(ctx, expected, by)
+	} else {
+		value, err = h.ctr.AddContext(ctx, by)
+	}
+	if err != nil {
+		writeChangeError(w, r, value, by, err)
+
+		return
+	}
+
+	h.stats.IncrementsTotal.Add(1)
+
+	writeValue(w, r, http.StatusOK, value)
+}
+
+func (h *handler) decrement(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	value, err := h.ctr.Decrement()
+	if err != nil {
+		writeChangeError(w, r, value, -1, err)
+
+		return
+	}
+
+	writeValue(w, r, http.StatusOK, value)
+}
+
+func (h *handler) resetCounter(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "POST, DELETE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	err := h.ctr.Set(0)
+	if err != nil {
+		writeChangeError(w, r, 0, 0, err)
+
+		return
+	}
+
+	writeValue(w, r, http.StatusOK, 0)
+}
+
+func (h *handler) setCounter(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		w.Header().Set("Allow", "POST, PUT")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	value, err := parseValue(r)
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+
+			return
+		}
+
+		requestLogger(r).Warn("invalid counter value", "error", err)
+		w.WriteHeader(http.StatusBadRequest)
+
+		return
+	}
+
+	err = h.ctr.Set(value)
+	if err != nil {
+		writeChangeError(w, r, value, 0, err)
+
+		return
+	}
+
+	writeValue(w, r, http.StatusOK, value)
+}
+
+// writeChangeError answers a failed change of the counter by delta. A
+// change leaving the allowed range or failing its If-Match is answered
+// with the current value.
+func writeChangeError(w http.ResponseWriter, r *http.Request, value, delta int64, err error) {
+	switch {
+	case errors.Is(err, counter.ErrOutOfRange):
+		writeValue(w, r, http.StatusConflict, value)
+	case errors.Is(err, counter.ErrMismatch):
+		writeValue(w, r, http.StatusPreconditionFailed, value)
+	case errors.Is(err, counter.ErrReadOnly):
+		w.WriteHeader(http.StatusForbidden)
+	case errors.Is(err, counter.ErrOverflow):
+		requestLogger(r).Error("counter overflow", "value", value, "step", delta)
+		w.WriteHeader(http.StatusInternalServerError)
+	default:
+		requestLogger(r).Error("unable to save counter", "error", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+}
+
+// healthz reports whether the store can still be read and written.
+func (h *handler) healthz(w http.ResponseWriter, r *http.Request) {
+	err := h.ctr.Check()
+	if err != nil {
+		requestLogger(r).Error("health check failed", "error", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *handler) namedCounter(w http.ResponseWriter, r *http.Request) {
+	value, ok := h.counters.Get(r.PathValue("name"))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+
+		return
+	}
+
+	writeValue(w, r, http.StatusOK, value)
+}
+
+func (h *handler) incrementNamed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	value, err := h.counters.Add(r.PathValue("name"), h.opts.Step)
+	if errors.Is(err, counter.ErrOverflow) {
+		requestLogger(r).Error("counter overflow", "value", value, "step", h.opts.Step)
+		w.WriteHeader(http.StatusInternalServerError)
+
+		return
+	}
+
+	if err != nil {
+		requestLogger(r).Error("unable to save counters", "file", h.counters.Path, "error", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+
+		return
+	}
+
+	writeValue(w, r, http.StatusOK, value)
+}
+
+// version writes Options.Version as JSON.
+func (h *handler) version(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, h.opts.Version)
+}
+
+// parseValue reads the new counter value from the 'value' query parameter
+// or, if it is not present, from the request body.
+func parseValue(r *http.Request) (int64, error) {
+	raw := r.URL.Query().Get("value")
+	if raw == "" {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return 0, err
+		}
+
+		raw = string(body)
+	}
+
+	return parseInt(raw)
+}
+
+// parseInt parses raw as a base 10 integer.
+func parseInt(raw string) (int64, error) {
+	return strconv.ParseInt(strings.TrimSpace(raw), 10, 64)
+}
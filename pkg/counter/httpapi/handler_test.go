@@ -0,0 +1,153 @@
+package httpapi
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matbits/counter/pkg/clock"
+	"github.com/matbits/counter/pkg/counter"
+)
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		opts       Options
+		readOnly   bool
+		method     string
+		target     string
+		token      string
+		wantStatus int
+		wantBody   string
+		wantAllow  string
+	}{
+		{name: "increment", method: http.MethodPost, target: "/hostname", wantStatus: http.StatusOK, wantBody: "1"},
+		{name: "increment by step", opts: Options{Step: 5}, method: http.MethodPost, target: "/hostname", wantStatus: http.StatusOK, wantBody: "5"},
+		{name: "increment by GET", method: http.MethodGet, target: "/hostname", wantStatus: http.StatusMethodNotAllowed, wantAllow: "POST"},
+		{name: "decrement", method: http.MethodPost, target: "/decrement", wantStatus: http.StatusOK, wantBody: "-1"},
+		{name: "decrement by GET", method: http.MethodGet, target: "/decrement", wantStatus: http.StatusMethodNotAllowed, wantAllow: "POST"},
+		{name: "named increment by GET", method: http.MethodGet, target: "/counters/a/increment", wantStatus: http.StatusMethodNotAllowed, wantAllow: "POST"},
+		{name: "named increment", method: http.MethodPost, target: "/counters/a/increment", wantStatus: http.StatusOK, wantBody: "1"},
+		{name: "missing named counter", method: http.MethodGet, target: "/counters/a", wantStatus: http.StatusNotFound},
+		{name: "latest", method: http.MethodGet, target: "/latest", wantStatus: http.StatusOK, wantBody: "0"},
+		{name: "set", method: http.MethodPut, target: "/set?value=42", wantStatus: http.StatusOK, wantBody: "42"},
+		{name: "read-only", readOnly: true, method: http.MethodPost, target: "/hostname", wantStatus: http.StatusForbidden},
+		{name: "missing token", opts: Options{AuthToken: "s"}, method: http.MethodPost, target: "/hostname", wantStatus: http.StatusUnauthorized},
+		{name: "valid token", opts: Options{AuthToken: "s"}, method: http.MethodPost, target: "/hostname", token: "s", wantStatus: http.StatusOK, wantBody: "1"},
+		{name: "open read", opts: Options{AuthToken: "s"}, method: http.MethodGet, target: "/latest", wantStatus: http.StatusOK, wantBody: "0"},
+		{name: "protected read", opts: Options{AuthToken: "s", AuthRead: true}, method: http.MethodGet, target: "/latest", wantStatus: http.StatusUnauthorized},
+		{name: "protected stats", opts: Options{AuthToken: "s", AuthRead: true}, method: http.MethodGet, target: "/stats", wantStatus: http.StatusUnauthorized},
+		{name: "protected metrics", opts: Options{AuthToken: "s", AuthRead: true}, method: http.MethodGet, target: "/metrics", wantStatus: http.StatusUnauthorized},
+		{name: "version not served", method: http.MethodGet, target: "/version", wantStatus: http.StatusNotFound},
+		{name: "version", opts: Options{Version: "1.0"}, method: http.MethodGet, target: "/version", wantStatus: http.StatusOK, wantBody: `"1.0"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := counter.New(&counter.MemoryStore{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c.ReadOnly = tt.readOnly
+
+			req := httptest.NewRequest(tt.method, tt.target, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+
+			rec := httptest.NewRecorder()
+			NewHandler(c, tt.opts).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+
+			if tt.wantBody != "" && strings.TrimSpace(rec.Body.String()) != tt.wantBody {
+				t.Errorf("body = %q, want %q", rec.Body.String(), tt.wantBody)
+			}
+
+			if got := rec.Header().Get("Allow"); got != tt.wantAllow {
+				t.Errorf("Allow = %q, want %q", got, tt.wantAllow)
+			}
+		})
+	}
+}
+
+func TestHostnameBounds(t *testing.T) {
+	tests := []struct {
+		name       string
+		init, max  int64
+		wantStatus int
+		wantBody   string
+		wantValue  int64
+	}{
+		{name: "up to max", init: 9, max: 10, wantStatus: http.StatusOK, wantBody: "10", wantValue: 10},
+		{name: "above max", init: 10, max: 10, wantStatus: http.StatusConflict, wantBody: "10", wantValue: 10},
+		{name: "overflow", init: math.MaxInt64, max: math.MaxInt64, wantStatus: http.StatusInternalServerError, wantValue: math.MaxInt64},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := counter.New(&counter.MemoryStore{Init: tt.init})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c.Max = tt.max
+
+			rec := httptest.NewRecorder()
+			NewHandler(c, Options{}).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/hostname", nil))
+
+			if rec.Code != tt.wantStatus || rec.Body.String() != tt.wantBody {
+				t.Errorf("POST /hostname = %d %q, want %d %q", rec.Code, rec.Body.String(), tt.wantStatus, tt.wantBody)
+			}
+
+			if got := c.Value(); got != tt.wantValue {
+				t.Errorf("Value() = %d, want %d", got, tt.wantValue)
+			}
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	c, err := counter.New(&counter.MemoryStore{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clk := clock.NewFake(time.Now())
+	h := NewHandler(c, Options{RateLimit: 0.5, RateBurst: 1, Clock: clk})
+
+	steps := []struct {
+		advance        time.Duration
+		wantStatus     int
+		wantRetryAfter string
+	}{
+		{wantStatus: http.StatusOK},
+		{wantStatus: http.StatusTooManyRequests, wantRetryAfter: "2"},
+		{advance: time.Second, wantStatus: http.StatusTooManyRequests, wantRetryAfter: "1"},
+		{advance: time.Second, wantStatus: http.StatusOK},
+		// a refill never exceeds the burst
+		{advance: time.Hour, wantStatus: http.StatusOK},
+		{wantStatus: http.StatusTooManyRequests, wantRetryAfter: "2"},
+	}
+
+	for i, step := range steps {
+		clk.Advance(step.advance)
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/hostname", nil))
+
+		if rec.Code != step.wantStatus {
+			t.Errorf("request %d: status = %d, want %d", i, rec.Code, step.wantStatus)
+		}
+
+		if got := rec.Header().Get("Retry-After"); got != step.wantRetryAfter {
+			t.Errorf("request %d: Retry-After = %q, want %q", i, got, step.wantRetryAfter)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package httpapi
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/matbits/counter/pkg/clock"
+)
+
+// History appends the changes of the counter made by requests of the
+// handler as JSON lines to the file Path. Other changes, e.g. by a
+// reload, are not recorded.
+type History struct {
+	Path string
+	// Clock timestamps the lines. clock.Real is used if nil.
+	Clock clock.Clock
+}
+
+// historyEntry is a line of the history file.
+type historyEntry struct {
+	Time   time.Time `json:"ts"`
+	Value  int64     `json:"value"`
+	Remote string    `json:"remote"`
+}
+
+// historyKey is the context key of the request whose change is recorded
+// in the history.
+type historyKey struct{}
+
+// withHistory returns the context of r marked for History.
+func withHistory(r *http.Request) context.Context {
+	return context.WithValue(r.Context(), historyKey{}, r)
+}
+
+// OnChange is meant as the OnChange hook of the counter. It appends
+// changes made with a context of withHistory while the counter is
+// locked, so the lines are in the order of the changes. A failed append
+// is only logged, it does not fail the change.
+func (h *History) OnChange(ctx context.Context, value int64) {
+	r, ok := ctx.Value(historyKey{}).(*http.Request)
+	if !ok {
+		return
+	}
+
+	err := h.append(r, value)
+	if err != nil {
+		requestLogger(r).Error("unable to append history", "file", h.Path, "error", err)
+	}
+}
+
+// append appends value as JSON line to Path. The line is written with a
+// single write to a file opened with O_APPEND, so concurrent writers
+// cannot interleave.
+func (h *History) append(r *http.Request, value int64) error {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+
+	out, err := json.Marshal(historyEntry{Time: clock.OrReal(h.Clock).Now().UTC(), Value: value, Remote: remote})
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(h.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(append(out, '\n'))
+	if err != nil {
+		f.Close()
+
+		return err
+	}
+
+	return f.Close()
+}
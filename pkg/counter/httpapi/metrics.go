@@ -0,0 +1,164 @@
+package httpapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats are the statistics of the handler served by /stats and
+// /metrics. The counters may be read while the handler runs.
+type Stats struct {
+	// Start is the time the handler was started.
+	Start            time.Time
+	HostnameRequests atomic.Int64
+	LatestRequests   atomic.Int64
+	IncrementsTotal  atomic.Int64
+	InFlight         atomic.Int64
+	PersistFailures  atomic.Int64
+
+	persistDuration *histogram
+}
+
+// NewStats returns empty statistics of a handler started at start.
+func NewStats(start time.Time) *Stats {
+	return &Stats{Start: start, persistDuration: newHistogram(0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1)}
+}
+
+// RecordPersist records a write to the store. It is meant as the
+// OnPersist hook of the counter.
+func (s *Stats) RecordPersist(d time.Duration, err error) {
+	s.persistDuration.observe(d.Seconds())
+
+	if err != nil {
+		s.PersistFailures.Add(1)
+	}
+}
+
+// histogram counts observations in buckets with the given upper bounds,
+// like a Prometheus histogram.
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []int64
+	sum    float64
+	count  int64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]int64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+
+	h.sum += v
+	h.count++
+}
+
+// write writes the histogram as metric name in the Prometheus text
+// exposition format, without HELP and TYPE lines.
+func (h *histogram) write(w io.Writer, name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, bound := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+	}
+
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n", name, h.sum)
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+// metrics writes the counter state in the Prometheus text exposition
+// format.
+func (h *handler) metrics(w http.ResponseWriter, r *http.Request) {
+	value := h.ctr.Value()
+
+	var out bytes.Buffer
+
+	fmt.Fprintf(&out, `# HELP counter_value Current value of the counter.
+# TYPE counter_value gauge
+counter_value %d
+# HELP counter_requests_total Handled requests per endpoint.
+# TYPE counter_requests_total counter
+counter_requests_total{handler="/hostname"} %d
+counter_requests_total{handler="/latest"} %d
+# HELP counter_increments_total Successful increments since process start.
+# TYPE counter_increments_total counter
+counter_increments_total %d
+# HELP counter_persist_failures_total Failed writes to the store.
+# TYPE counter_persist_failures_total counter
+counter_persist_failures_total %d
+# HELP counter_persist_duration_seconds Duration of writes to the store.
+# TYPE counter_persist_duration_seconds histogram
+`, value, h.stats.HostnameRequests.Load(), h.stats.LatestRequests.Load(), h.stats.IncrementsTotal.Load(), h.stats.PersistFailures.Load())
+
+	h.stats.persistDuration.write(&out, "counter_persist_duration_seconds")
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	_, err := w.Write(out.Bytes())
+	if err != nil {
+		requestLogger(r).Error("unable to write metrics", "error", err)
+	}
+}
+
+// statsResponse is the body of the /stats endpoint.
+type statsResponse struct {
+	Value            int64      `json:"value"`
+	StartTime        time.Time  `json:"start_time"`
+	UptimeSeconds    float64    `json:"uptime_seconds"`
+	HostnameRequests int64      `json:"hostname_requests"`
+	LatestRequests   int64      `json:"latest_requests"`
+	LastPersist      *time.Time `json:"last_persist"`
+	PersistFailures  int64      `json:"persist_failures"`
+}
+
+// statsHandler writes the counter value and operational statistics as
+// JSON.
+func (h *handler) statsHandler(w http.ResponseWriter, r *http.Request) {
+	value := h.ctr.Value()
+
+	resp := statsResponse{
+		Value:            value,
+		StartTime:        h.stats.Start,
+		UptimeSeconds:    h.clk.Now().Sub(h.stats.Start).Seconds(),
+		HostnameRequests: h.stats.HostnameRequests.Load(),
+		LatestRequests:   h.stats.LatestRequests.Load(),
+		PersistFailures:  h.stats.PersistFailures.Load(),
+	}
+
+	if t := h.ctr.LastPersist(); !t.IsZero() {
+		resp.LastPersist = &t
+	}
+
+	out, err := json.Marshal(resp)
+	if err != nil {
+		requestLogger(r).Error("unable to marshal stats", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	_, err = w.Write(out)
+	if err != nil {
+		requestLogger(r).Error("unable to write stats", "error", err)
+	}
+}
@@ -0,0 +1,41 @@
+package httpapi
+
+import (
+	"net/http"
+)
+
+// rejectReadOnly answers every request with 403 if the counter is
+// read-only.
+func (h *handler) rejectReadOnly(next http.HandlerFunc) http.HandlerFunc {
+	if !h.ctr.ReadOnly {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}
+}
+
+// limitBody rejects request bodies larger than MaxBodySize. Handlers
+// reading the body get an *http.MaxBytesError once the limit is hit.
+func (h *handler) limitBody(next http.HandlerFunc) http.HandlerFunc {
+	if h.opts.MaxBodySize <= 0 {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, h.opts.MaxBodySize)
+
+		next(w, r)
+	}
+}
+
+// trackInFlight counts the requests currently handled by next.
+func (h *handler) trackInFlight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.stats.InFlight.Add(1)
+		defer h.stats.InFlight.Add(-1)
+
+		next.ServeHTTP(w, r)
+	})
+}
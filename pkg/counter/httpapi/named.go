@@ -0,0 +1,103 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/matbits/counter/pkg/counter"
+	"github.com/matbits/counter/pkg/counter/internal/overflow"
+	"github.com/matbits/counter/pkg/fhandler"
+)
+
+// NamedCounters are the counters of /counters/{name}, stored as a single
+// JSON object in the file Path. They are kept in memory only if Path is
+// empty. It is safe for concurrent use.
+type NamedCounters struct {
+	Path string
+
+	mu     sync.RWMutex
+	values map[string]int64
+}
+
+// Load reads the counters from Path. A missing file is not an error, it
+// is created by the first Add.
+func (n *NamedCounters) Load() error {
+	if n.Path == "" {
+		return nil
+	}
+
+	content, err := os.ReadFile(n.Path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return json.Unmarshal(content, &n.values)
+}
+
+// Get returns the value of the counter name and whether it exists.
+func (n *NamedCounters) Get(name string) (int64, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	value, ok := n.values[name]
+
+	return value, ok
+}
+
+// Add adds delta to the counter name, which starts at zero, and returns
+// the new value. If the sum overflows or cannot be saved, the counter is
+// unchanged; on overflow its value is returned with counter.ErrOverflow.
+func (n *NamedCounters) Add(name string, delta int64) (int64, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	old, exists := n.values[name]
+
+	sum, ok := overflow.Add(old, delta)
+	if !ok {
+		return old, counter.ErrOverflow
+	}
+
+	if n.values == nil {
+		n.values = make(map[string]int64)
+	}
+
+	n.values[name] = sum
+
+	err := n.saveLocked()
+	if err != nil {
+		if exists {
+			n.values[name] = old
+		} else {
+			delete(n.values, name)
+		}
+
+		return 0, err
+	}
+
+	return sum, nil
+}
+
+// saveLocked writes the counters to Path, unless it is empty. The caller
+// must hold the write lock of mu.
+func (n *NamedCounters) saveLocked() error {
+	if n.Path == "" {
+		return nil
+	}
+
+	out, err := json.Marshal(n.values)
+	if err != nil {
+		return err
+	}
+
+	return fhandler.WriteAtomic("", ".counters", n.Path, out, 0644)
+}
@@ -0,0 +1,106 @@
+package httpapi
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxBuckets is the number of per client buckets after which idle ones
+// are dropped.
+const maxBuckets = 10000
+
+// tokenBucket allows burst requests at once and refills at rate tokens
+// per second.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limiter is a token bucket rate limiter, either global or per client.
+type limiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	perIP   bool
+	buckets map[string]*tokenBucket
+}
+
+func newLimiter(rate float64, burst int, perIP bool) *limiter {
+	return &limiter{
+		rate:    rate,
+		burst:   float64(max(burst, 1)),
+		perIP:   perIP,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token for key. If none is left it returns false and the
+// time until the next token is available.
+func (l *limiter) allow(key string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.perIP {
+		key = ""
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxBuckets {
+			l.prune(now)
+		}
+
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+
+		return true, 0
+	}
+
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// prune drops the buckets which are refilled completely, a new bucket
+// starts full anyway.
+func (l *limiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// rateLimit rejects requests exceeding the limiter with 429. Every
+// request is accepted if no RateLimit is configured.
+func (h *handler) rateLimit(next http.HandlerFunc) http.HandlerFunc {
+	if h.limiter == nil {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+
+		ok, wait := h.limiter.allow(host, h.clk.Now())
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			w.WriteHeader(http.StatusTooManyRequests)
+
+			return
+		}
+
+		next(w, r)
+	}
+}
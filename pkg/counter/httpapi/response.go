@@ -0,0 +1,81 @@
+package httpapi
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// writeValue writes value with status as response body. The value is
+// written as JSON object if the client accepts application/json and as
+// plain text otherwise.
+func writeValue(w http.ResponseWriter, r *http.Request, status int, value int64) {
+	if acceptsJSON(r) {
+		writeJSON(w, r, status, struct {
+			Value int64 `json:"value"`
+		}{value})
+
+		return
+	}
+
+	writeBody(w, r, status, "text/plain; charset=utf-8", []byte(strconv.FormatInt(value, 10)))
+}
+
+// writeJSON writes v as JSON response body.
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v any) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		requestLogger(r).Error("unable to marshal response", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+
+		return
+	}
+
+	writeBody(w, r, status, "application/json", out)
+}
+
+// writeBody writes out with status and contentType as response. For HEAD
+// requests only the headers are written.
+func writeBody(w http.ResponseWriter, r *http.Request, status int, contentType string, out []byte) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(out)))
+	w.WriteHeader(status)
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	_, err := w.Write(out)
+	if err != nil {
+		requestLogger(r).Error("unable to write response", "error", err)
+	}
+}
+
+// acceptsJSON reports whether the Accept header of r lists
+// application/json.
+func acceptsJSON(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			mediaType, _, _ := strings.Cut(mediaRange, ";")
+			if strings.TrimSpace(mediaType) == "application/json" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// requestLogger returns the default logger with the fields of r,
+// including its request ID if it has one.
+func requestLogger(r *http.Request) *slog.Logger {
+	logger := slog.With("method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
+
+	if id := requestID(r); id != "" {
+		logger = logger.With("request_id", id)
+	}
+
+	return logger
+}
@@ -0,0 +1,13 @@
+// Package overflow implements integer arithmetic detecting overflows for
+// the counter packages.
+package overflow
+
+// Add returns a+b and false if the sum overflows.
+func Add(a, b int64) (int64, bool) {
+	sum := a + b
+	if (b > 0 && sum < a) || (b < 0 && sum > a) {
+		return 0, false
+	}
+
+	return sum, true
+}
@@ -0,0 +1,36 @@
+package counter
+
+import "sync"
+
+// MemoryStore keeps the counter in memory only, it starts at Init and is
+// lost when the process exits. It is safe for concurrent use.
+type MemoryStore struct {
+	Init int64
+
+	mu     sync.Mutex
+	value  int64
+	loaded bool
+}
+
+// Load returns the saved value, Init if there was no Save.
+func (s *MemoryStore) Load() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.loaded {
+		s.value = s.Init
+		s.loaded = true
+	}
+
+	return s.value, nil
+}
+
+func (s *MemoryStore) Save(value int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.value = value
+	s.loaded = true
+
+	return nil
+}
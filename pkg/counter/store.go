@@ -0,0 +1,272 @@
+package counter
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/matbits/counter/pkg/fhandler"
+)
+
+// Store persists the counter value.
+//
+// Load returns the stored value. A store without a value returns zero.
+//
+// Save replaces the stored value.
+type Store interface {
+	Load() (int64, error)
+	Save(int64) error
+}
+
+// Checker is implemented by stores whose health can be checked without
+// changing them. Check returns an error if the stored value cannot be
+// read or, with write set, if the store could not be saved.
+type Checker interface {
+	Check(write bool) error
+}
+
+// BackupSuffix is appended to the path of a FileStore to name its
+// backup sidecar.
+const BackupSuffix = ".bak"
+
+// FileStore stores the counter as JSON number in the file Path.
+type FileStore struct {
+	Path string
+	// Init is the value the file is created with if it does not exist.
+	Init int64
+	// Backup keeps the previous content of the file in the backup
+	// sidecar on every Save.
+	Backup bool
+	// ReadOnly never writes the file: Load fails instead of creating,
+	// migrating or rolling it back and Save fails with ErrReadOnly.
+	ReadOnly bool
+}
+
+// Load reads the counter from the file, which is initialized with Init
+// if it does not exist. An empty file holds zero. If the file cannot be
+// decoded, or is missing while there is a backup sidecar, the file is
+// rolled back to the backup. Files of older versions holding a float are
+// rewritten as integer. With ReadOnly, all of these fail with an error
+// wrapping ErrReadOnly instead.
+func (s *FileStore) Load() (int64, error) {
+	err := s.create()
+	if err != nil {
+		return 0, err
+	}
+
+	content, err := os.ReadFile(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s.loadBackup(err)
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	if len(bytes.TrimSpace(content)) == 0 {
+		slog.Warn("counter file is empty, using zero", "file", s.Path)
+
+		return 0, nil
+	}
+
+	value, migrated, err := decodeNumber(content)
+	if err != nil {
+		return s.loadBackup(err)
+	}
+
+	if migrated {
+		if s.ReadOnly {
+			return 0, fmt.Errorf("unable to migrate: %w", ErrReadOnly)
+		}
+
+		err = s.Save(value)
+		if err != nil {
+			return 0, fmt.Errorf("unable to migrate: %w", err)
+		}
+
+		slog.Info("migrated file to integer format", "file", s.Path)
+	}
+
+	return value, nil
+}
+
+// Save writes value atomically to the file, keeping its permission.
+func (s *FileStore) Save(value int64) error {
+	if s.ReadOnly {
+		return ErrReadOnly
+	}
+
+	out, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	if !s.Backup {
+		return fhandler.WriteAtomicKeepMode("", ".counter", s.Path, out, 0644)
+	}
+
+	permission := os.FileMode(0644)
+
+	fi, err := os.Stat(s.Path)
+	if err == nil {
+		permission = fi.Mode().Perm()
+	}
+
+	return fhandler.WriteAtomicBackup("", ".counter", s.Path, out, permission, BackupSuffix)
+}
+
+// Verify decodes the file like Load, but never writes: a missing file is
+// not created, a float file is not migrated and the backup is not used.
+// An empty file is reported as error.
+func (s *FileStore) Verify() (int64, error) {
+	content, err := os.ReadFile(s.Path)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(bytes.TrimSpace(content)) == 0 {
+		return 0, errors.New("file is empty")
+	}
+
+	value, _, err := decodeNumber(content)
+
+	return value, err
+}
+
+// Check verifies the file without writing to it. With write set, it also
+// checks that the file can be replaced.
+func (s *FileStore) Check(write bool) error {
+	return checkFile(s.Path, s.Verify, write)
+}
+
+// loadBackup rolls the file back to the backup sidecar and returns its
+// value. cause is the error reading the file, which is returned if there
+// is no backup.
+func (s *FileStore) loadBackup(cause error) (int64, error) {
+	backup := s.Path + BackupSuffix
+
+	content, err := os.ReadFile(backup)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, cause
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	value, _, err := decodeNumber(content)
+	if err != nil {
+		return 0, fmt.Errorf("unable to decode backup %s: %w", backup, err)
+	}
+
+	if s.ReadOnly {
+		return 0, fmt.Errorf("%w, unable to restore backup %s: %w", cause, backup, ErrReadOnly)
+	}
+
+	err = fhandler.WriteAtomicKeepMode("", ".counter", s.Path, content, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("unable to restore backup %s: %w", backup, err)
+	}
+
+	slog.Error("counter file is corrupt, rolled back to the backup", "file", s.Path, "backup", backup, "value", value, "error", cause)
+
+	return value, nil
+}
+
+// create initializes a missing file with Init. A missing file with a
+// backup sidecar was lost by an interrupted Save with Backup, so it is
+// left to Load to roll back.
+func (s *FileStore) create() error {
+	_, err := os.Stat(s.Path)
+	if err == nil {
+		return nil
+	}
+
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	_, err = os.Stat(s.Path + BackupSuffix)
+	if err == nil {
+		return nil
+	}
+
+	if s.ReadOnly {
+		return fmt.Errorf("unable to create %s: %w", s.Path, ErrReadOnly)
+	}
+
+	return s.Save(s.Init)
+}
+
+// checkFile checks that path is a regular file decoded by verify and, with
+// write set, that it can be opened for writing and a temporary file can
+// be created next to it, as needed by an atomic replace. Nothing is
+// written to path.
+func checkFile(path string, verify func() (int64, error), write bool) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("unable to read: %w", err)
+	}
+
+	if !fi.Mode().IsRegular() {
+		return fmt.Errorf("unable to read: %s is not a regular file", path)
+	}
+
+	_, err = verify()
+	if err != nil {
+		return fmt.Errorf("unable to read: %w", err)
+	}
+
+	if !write {
+		return nil
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("unable to write: %w", err)
+	}
+
+	f.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".counter-check")
+	if err != nil {
+		return fmt.Errorf("unable to write: %w", err)
+	}
+
+	tmp.Close()
+
+	return os.Remove(tmp.Name())
+}
+
+// decodeNumber unmarshals the stored counter. Files written by older
+// versions hold a float such as 42 or 4.2e+07; those are converted and
+// migrated is set so the caller can rewrite the file as an integer.
+func decodeNumber(content []byte) (value int64, migrated bool, err error) {
+	var raw json.Number
+
+	err = json.Unmarshal(content, &raw)
+	if err != nil {
+		return 0, false, err
+	}
+
+	value, err = raw.Int64()
+	if err == nil {
+		return value, false, nil
+	}
+
+	f, err := raw.Float64()
+	if err != nil {
+		return 0, false, err
+	}
+
+	if f < math.MinInt64 || f >= math.MaxInt64 || math.IsNaN(f) {
+		return 0, false, fmt.Errorf("value '%s' out of range", raw)
+	}
+
+	return int64(f), true, nil
+}
@@ -0,0 +1,144 @@
+package counter
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCounterCheckReadOnly(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		backup  string
+		missing bool
+		wantErr bool
+	}{
+		{name: "integer", content: "42"},
+		{name: "float of an older version", content: "4.2e+01"},
+		{name: "corrupt with backup", content: "x", backup: "41", wantErr: true},
+		{name: "missing with backup", missing: true, backup: "41", wantErr: true},
+		{name: "missing", missing: true, wantErr: true},
+		{name: "empty", content: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "counter.txt")
+
+			for _, store := range []Store{&FileStore{Path: path}, &WALStore{Path: path}} {
+				// the counter must load a healthy file before it is removed
+				// or broken behind its back
+				err := os.WriteFile(path, []byte("1"), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				c, err := New(store)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				os.Remove(path)
+				if !tt.missing {
+					writeFile(t, path, tt.content)
+				}
+
+				os.Remove(path + BackupSuffix)
+				if tt.backup != "" {
+					writeFile(t, path+BackupSuffix, tt.backup)
+				}
+
+				err = c.Check()
+				if (err != nil) != tt.wantErr {
+					t.Errorf("%T: Check() = %v, want error %v", store, err, tt.wantErr)
+				}
+
+				content, err := os.ReadFile(path)
+				if tt.missing != os.IsNotExist(err) || string(content) != tt.content {
+					t.Errorf("%T: Check changed the file to %q, %v", store, content, err)
+				}
+
+				want := 0
+				if !tt.missing {
+					want++
+				}
+
+				if tt.backup != "" {
+					want++
+				}
+
+				entries, _ := os.ReadDir(dir)
+				if len(entries) != want {
+					t.Errorf("%T: Check left %d files, want %d", store, len(entries), want)
+				}
+			}
+		})
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+
+	err := os.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStoreReadOnlyLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		wal     bool
+		content string
+		backup  string
+		missing bool
+		want    int64
+		wantErr bool
+	}{
+		{name: "integer", content: "42", want: 42},
+		{name: "missing", missing: true, wantErr: true},
+		{name: "float of an older version", content: "4.2e+01", wantErr: true},
+		{name: "corrupt with backup", content: "x", backup: "41", wantErr: true},
+		{name: "log", wal: true, content: "41\n42\n", want: 42},
+		{name: "missing log", wal: true, missing: true, wantErr: true},
+		{name: "torn log", wal: true, content: "41\n42\n4", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "counter.txt")
+
+			if !tt.missing {
+				writeFile(t, path, tt.content)
+			}
+
+			if tt.backup != "" {
+				writeFile(t, path+BackupSuffix, tt.backup)
+			}
+
+			var store Store = &FileStore{Path: path, Init: 7, ReadOnly: true}
+			if tt.wal {
+				store = &WALStore{Path: path, Init: 7, ReadOnly: true}
+			}
+
+			got, err := store.Load()
+			if tt.wantErr != errors.Is(err, ErrReadOnly) || got != tt.want {
+				t.Errorf("Load() = %d, %v, want %d, error %v", got, err, tt.want, tt.wantErr)
+			}
+
+			content, err := os.ReadFile(path)
+			if tt.missing != os.IsNotExist(err) || string(content) != tt.content {
+				t.Errorf("Load changed the file to %q, %v", content, err)
+			}
+
+			err = store.Save(1)
+			if !errors.Is(err, ErrReadOnly) {
+				t.Errorf("Save(1) = %v, want %v", err, ErrReadOnly)
+			}
+		})
+	}
+}
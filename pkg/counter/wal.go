@@ -0,0 +1,302 @@
+package counter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/matbits/counter/pkg/fhandler"
+)
+
+// WALStore stores the counter as an append-only log in the file Path.
+// Every Save appends the value as a line and syncs it, which is far
+// cheaper than rewriting the file, and the last complete line is the
+// stored value.
+// Compact shrinks the log to a single line again. It is safe for
+// concurrent use.
+type WALStore struct {
+	Path string
+	// Init is the value the log is created with if it does not exist.
+	Init int64
+	// ReadOnly never writes the log: Load fails instead of creating or
+	// compacting it and Save fails with ErrReadOnly.
+	ReadOnly bool
+
+	mu   sync.Mutex
+	file logFile
+	// size is the length of the log up to its last complete record while
+	// file is open.
+	size int64
+	// broken is set if a failed append could not be cut off again, the
+	// log must be compacted before it is appended to.
+	broken bool
+	// value is the last loaded or saved value, records the number of
+	// lines appended since the log was loaded or compacted.
+	value   int64
+	records int
+}
+
+// logFile is the part of *os.File used to append to the log.
+type logFile interface {
+	io.Writer
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+// Load replays the log and returns the value of its last complete line.
+// The log is created with Init if it does not exist and an empty log
+// holds zero. A file without any newline, as written by FileStore, is
+// read as a single record and compacted, so the next record does not
+// continue it. A torn last line of an interrupted Save is dropped and the
+// log is compacted as well. With ReadOnly, creating the log and dropping
+// a torn line fail with an error wrapping ErrReadOnly instead, and an
+// unterminated record is left alone.
+func (s *WALStore) Load() (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	content, err := os.ReadFile(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		if s.ReadOnly {
+			return 0, fmt.Errorf("unable to create %s: %w", s.Path, ErrReadOnly)
+		}
+
+		err = s.compactLocked(s.Init)
+		if err != nil {
+			return 0, err
+		}
+
+		return s.Init, nil
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	value, torn, err := replay(content)
+	if err != nil {
+		return 0, err
+	}
+
+	s.value = value
+	s.records = 0
+
+	if torn {
+		if s.ReadOnly {
+			return 0, fmt.Errorf("unable to drop torn record: %w", ErrReadOnly)
+		}
+
+		slog.Warn("dropping torn record of write-ahead log", "file", s.Path)
+
+		err = s.compactLocked(value)
+		if err != nil {
+			return 0, fmt.Errorf("unable to compact: %w", err)
+		}
+
+		return value, nil
+	}
+
+	if len(content) > 0 && content[len(content)-1] != '\n' && !s.ReadOnly {
+		err = s.compactLocked(value)
+		if err != nil {
+			return 0, fmt.Errorf("unable to compact: %w", err)
+		}
+	}
+
+	return value, nil
+}
+
+// Verify replays the log like Load, but never writes: a missing log is
+// not created and a torn last record is not dropped. An empty log and a
+// torn record are reported as error.
+func (s *WALStore) Verify() (int64, error) {
+	content, err := os.ReadFile(s.Path)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(bytes.TrimSpace(content)) == 0 {
+		return 0, errors.New("file is empty")
+	}
+
+	value, torn, err := replay(content)
+	if err != nil {
+		return 0, err
+	}
+
+	if torn {
+		return value, errors.New("log ends in a torn record")
+	}
+
+	return value, nil
+}
+
+// Check verifies the log without writing to it. With write set, it also
+// checks that the log can be appended to and compacted.
+func (s *WALStore) Check(write bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return checkFile(s.Path, s.Verify, write)
+}
+
+// Save appends value to the log and syncs it. If the append fails, the
+// partial record is cut off again, so the next record does not continue
+// it. If that fails as well, the next Save compacts the log instead of
+// appending.
+func (s *WALStore) Save(value int64) error {
+	if s.ReadOnly {
+		return ErrReadOnly
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.broken {
+		return s.compactLocked(value)
+	}
+
+	if s.file == nil {
+		f, err := os.OpenFile(s.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+
+			return err
+		}
+
+		s.file = f
+		s.size = fi.Size()
+	}
+
+	record := append(strconv.AppendInt(nil, value, 10), '\n')
+
+	_, err := s.file.Write(record)
+	if err == nil {
+		err = s.file.Sync()
+	}
+	if err != nil {
+		s.discardLocked()
+
+		return err
+	}
+
+	s.size += int64(len(record))
+	s.value = value
+	s.records++
+
+	return nil
+}
+
+// discardLocked cuts the log back to its last complete record after a
+// failed append. If that fails, the log is closed and marked broken. The
+// caller must hold mu.
+func (s *WALStore) discardLocked() {
+	err := s.file.Truncate(s.size)
+	if err == nil {
+		return
+	}
+
+	slog.Error("unable to cut off failed record of write-ahead log", "file", s.Path, "error", err)
+
+	s.file.Close()
+	s.file = nil
+	s.broken = true
+}
+
+// Compact atomically replaces the log with a single record of the last
+// saved value. It does nothing if nothing was saved since the log was
+// loaded or compacted and the log is not broken.
+func (s *WALStore) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.records == 0 && !s.broken {
+		return nil
+	}
+
+	return s.compactLocked(s.value)
+}
+
+// Close compacts the log and closes it. A later Save opens it again.
+func (s *WALStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	if s.records > 0 || s.broken {
+		err = s.compactLocked(s.value)
+	}
+
+	if s.file != nil {
+		cerr := s.file.Close()
+		s.file = nil
+
+		if err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+// compactLocked replaces the log with value. The append handle refers to
+// the replaced file afterwards, so it is closed and reopened by the next
+// Save. The caller must hold mu.
+func (s *WALStore) compactLocked(value int64) error {
+	err := fhandler.WriteAtomicKeepMode("", ".counter-wal", s.Path, append(strconv.AppendInt(nil, value, 10), '\n'), 0644)
+	if err != nil {
+		return err
+	}
+
+	if s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+
+	s.value = value
+	s.records = 0
+	s.broken = false
+
+	return nil
+}
+
+// replay returns the value of the last complete line of a log. torn is
+// set if the content ends in an incomplete line, which is ignored unless
+// it is the only one.
+func replay(content []byte) (value int64, torn bool, err error) {
+	if len(bytes.TrimSpace(content)) == 0 {
+		return 0, false, nil
+	}
+
+	i := bytes.LastIndexByte(content, '\n')
+	if i < 0 {
+		value, _, err = decodeNumber(content)
+
+		return value, false, err
+	}
+
+	torn = len(bytes.TrimSpace(content[i+1:])) > 0
+
+	content = bytes.TrimSpace(content[:i])
+	if j := bytes.LastIndexByte(content, '\n'); j >= 0 {
+		content = content[j+1:]
+	}
+
+	value, err = strconv.ParseInt(string(bytes.TrimSpace(content)), 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("unable to decode last record: %w", err)
+	}
+
+	return value, torn, nil
+}
@@ -0,0 +1,207 @@
+package counter
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var errInjected = errors.New("injected failure")
+
+// faultyFile is a logFile on a real file whose next Write stops after
+// short bytes with an error. It counts the calls of Sync.
+type faultyFile struct {
+	*os.File
+	short        int
+	failTruncate bool
+	syncs        int
+}
+
+func (f *faultyFile) Write(p []byte) (int, error) {
+	if f.short < 0 {
+		return f.File.Write(p)
+	}
+
+	n, _ := f.File.Write(p[:f.short])
+	f.short = -1
+
+	return n, errInjected
+}
+
+func (f *faultyFile) Sync() error {
+	f.syncs++
+
+	return f.File.Sync()
+}
+
+func (f *faultyFile) Truncate(size int64) error {
+	if f.failTruncate {
+		return errInjected
+	}
+
+	return f.File.Truncate(size)
+}
+
+// openFaulty loads a WALStore on a log holding content and replaces its
+// append handle with a faultyFile.
+func openFaulty(t *testing.T, content string, short int, failTruncate bool) (*WALStore, *faultyFile) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "counter.txt")
+
+	err := os.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &WALStore{Path: path}
+
+	_, err = s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { f.Close() })
+
+	ff := &faultyFile{File: f, short: short, failTruncate: failTruncate}
+	s.file = ff
+	s.size = int64(len(content))
+
+	return s, ff
+}
+
+func TestWALStoreSaveSyncs(t *testing.T) {
+	s, ff := openFaulty(t, "1\n", -1, false)
+
+	for _, value := range []int64{2, 3} {
+		err := s.Save(value)
+		if err != nil {
+			t.Fatalf("Save(%d): %v", value, err)
+		}
+	}
+
+	if ff.syncs != 2 {
+		t.Errorf("got %d syncs for 2 saves, want 2", ff.syncs)
+	}
+}
+
+func TestWALStoreFailedAppend(t *testing.T) {
+	tests := []struct {
+		name         string
+		short        int
+		failTruncate bool
+		want         string
+	}{
+		{name: "nothing written", short: 0, want: "11\n13\n"},
+		{name: "partial record", short: 2, want: "11\n13\n"},
+		{name: "record without newline", short: 3, want: "11\n13\n"},
+		// the log is compacted instead of appended to
+		{name: "partial record, truncate fails", short: 2, failTruncate: true, want: "13\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := openFaulty(t, "11\n", tt.short, tt.failTruncate)
+
+			err := s.Save(123)
+			if !errors.Is(err, errInjected) {
+				t.Fatalf("Save(123) = %v, want %v", err, errInjected)
+			}
+
+			err = s.Save(13)
+			if err != nil {
+				t.Fatalf("Save(13): %v", err)
+			}
+
+			got, err := (&WALStore{Path: s.Path}).Verify()
+			if err != nil || got != 13 {
+				t.Errorf("Verify() = %d, %v, want 13, nil", got, err)
+			}
+
+			content, err := os.ReadFile(s.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(content) != tt.want {
+				t.Errorf("log is %q, want %q", content, tt.want)
+			}
+		})
+	}
+}
+
+func TestWALStoreVerify(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    int64
+		wantErr bool
+	}{
+		{name: "single record", content: "7\n", want: 7},
+		{name: "several records", content: "7\n8\n9\n", want: 9},
+		{name: "file store format", content: "42", want: 42},
+		{name: "torn record", content: "7\n8\n9", want: 8, wantErr: true},
+		{name: "empty", content: "", wantErr: true},
+		{name: "garbage", content: "7\nxx\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "counter.txt")
+
+			err := os.WriteFile(path, []byte(tt.content), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := (&WALStore{Path: path}).Verify()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Verify() error = %v, want error %v", err, tt.wantErr)
+			}
+
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("Verify() = %d, want %d", got, tt.want)
+			}
+
+			content, _ := os.ReadFile(path)
+			if string(content) != tt.content {
+				t.Errorf("Verify changed the log to %q", content)
+			}
+		})
+	}
+}
+
+func TestWALStoreAfterFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "counter.txt")
+
+	err := (&FileStore{Path: path}).Save(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &WALStore{Path: path}
+
+	got, err := s.Load()
+	if err != nil || got != 42 {
+		t.Fatalf("Load() = %d, %v, want 42, nil", got, err)
+	}
+
+	err = s.Save(43)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer s.Close()
+
+	// reload without Close, which would compact the log
+	got, err = (&WALStore{Path: path}).Load()
+	if err != nil || got != 43 {
+		t.Errorf("reloaded Load() = %d, %v, want 43, nil", got, err)
+	}
+}
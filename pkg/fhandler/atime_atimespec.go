@@ -0,0 +1,21 @@
+//go:build darwin || freebsd || netbsd
+// +build darwin freebsd netbsd
+
+package fhandler
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// atime returns the access time of fi or its modification time if the
+// access time is not available.
+func atime(fi os.FileInfo) time.Time {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fi.ModTime()
+	}
+
+	return time.Unix(int64(st.Atimespec.Sec), int64(st.Atimespec.Nsec))
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !openbsd && !dragonfly && !darwin && !freebsd && !netbsd
+// +build !linux,!openbsd,!dragonfly,!darwin,!freebsd,!netbsd
+
+package fhandler
+
+import (
+	"os"
+	"time"
+)
+
+// atime returns the modification time of fi, the access time is not
+// available on this platform.
+func atime(fi os.FileInfo) time.Time {
+	return fi.ModTime()
+}
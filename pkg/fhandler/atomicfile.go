@@ -0,0 +1,98 @@
+package fhandler
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrAtomicFileClosed for when an AtomicFile is used after Commit or Abort.
+var ErrAtomicFileClosed = errors.New("atomic file already committed or aborted")
+
+// AtomicFile is a temporary file which replaces its target on Commit. Its
+// content is not visible under the target name until then.
+type AtomicFile struct {
+	file       string
+	permission os.FileMode
+	tmpFile    *os.File
+}
+
+// NewAtomicFile creates a temporary file in dir, which replaces file with
+// the given permission on Commit. If dir is empty, the directory of file
+// is used, so the rename of Commit stays on the same file system.
+func NewAtomicFile(dir string, prefix string, file string, permission os.FileMode) (*AtomicFile, error) {
+	if dir == "" {
+		dir = filepath.Dir(file)
+	}
+
+	if !strings.Contains(prefix, "*") {
+		prefix = prefix + "_*"
+	}
+
+	tmpFile, err := os.CreateTemp(dir, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AtomicFile{file: file, permission: permission, tmpFile: tmpFile}, nil
+}
+
+// Write writes b to the temporary file.
+func (a *AtomicFile) Write(b []byte) (int, error) {
+	if a.tmpFile == nil {
+		return 0, ErrAtomicFileClosed
+	}
+
+	return a.tmpFile.Write(b)
+}
+
+// Commit syncs the temporary file and moves it to the target. The parent
+// directory of the target is synced as well, so the content is durable
+// once Commit returns without error. On error the temporary file is
+// removed.
+func (a *AtomicFile) Commit() error {
+	if a.tmpFile == nil {
+		return ErrAtomicFileClosed
+	}
+
+	tmpFile := a.tmpFile
+	a.tmpFile = nil
+
+	err := tmpFile.Chmod(a.permission)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+
+	cerr := tmpFile.Close()
+	if err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = Rename(tmpFile.Name(), a.file)
+	}
+
+	if err != nil {
+		os.Remove(tmpFile.Name())
+
+		return err
+	}
+
+	return syncDir(filepath.Dir(a.file))
+}
+
+// Abort closes and removes the temporary file, the target is left
+// unchanged.
+func (a *AtomicFile) Abort() error {
+	if a.tmpFile == nil {
+		return ErrAtomicFileClosed
+	}
+
+	tmpFile := a.tmpFile
+	a.tmpFile = nil
+
+	tmpFile.Close()
+
+	return os.Remove(tmpFile.Name())
+}
@@ -0,0 +1,66 @@
+package fhandler
+
+import (
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestAtomicFile(t *testing.T) {
+	tests := []struct {
+		name   string
+		finish func(a *AtomicFile) error
+		want   string
+	}{
+		{name: "commit", finish: (*AtomicFile).Commit, want: "new"},
+		{name: "abort", finish: (*AtomicFile).Abort, want: "old"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			file := filepath.Join(dir, "target")
+			writeFile(t, file, "old")
+
+			a, err := NewAtomicFile("", ".test", file, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = a.Write([]byte("new"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := readFile(t, file); got != "old" {
+				t.Errorf("file holds %q before %s, want %q", got, tt.name, "old")
+			}
+
+			err = tt.finish(a)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := readFile(t, file); got != tt.want {
+				t.Errorf("file holds %q, want %q", got, tt.want)
+			}
+
+			if got := listTree(t, dir); !slices.Equal(got, []string{"target"}) {
+				t.Errorf("directory holds %q, want only the target", got)
+			}
+
+			_, err = a.Write([]byte("x"))
+			if !errors.Is(err, ErrAtomicFileClosed) {
+				t.Errorf("Write() after %s = %v, want %v", tt.name, err, ErrAtomicFileClosed)
+			}
+
+			for _, finish := range []func() error{a.Commit, a.Abort} {
+				err = finish()
+				if !errors.Is(err, ErrAtomicFileClosed) {
+					t.Errorf("second finish after %s = %v, want %v", tt.name, err, ErrAtomicFileClosed)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd && !openbsd && !netbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!openbsd,!netbsd,!dragonfly
+
+package fhandler
+
+import (
+	"os"
+)
+
+// chown does nothing, the platform has no Unix ownership.
+func chown(path string, fi os.FileInfo) error {
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd || dragonfly
+// +build linux darwin freebsd openbsd netbsd dragonfly
+
+package fhandler
+
+import (
+	"os"
+	"syscall"
+)
+
+// chown sets the owner and group of path to the ones of fi.
+func chown(path string, fi os.FileInfo) error {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+
+	return os.Chown(path, int(st.Uid), int(st.Gid))
+}
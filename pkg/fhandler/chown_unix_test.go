@@ -0,0 +1,75 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd || dragonfly
+// +build linux darwin freebsd openbsd netbsd dragonfly
+
+package fhandler
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestCopyWithOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing the owner requires root")
+	}
+
+	const uid, gid = 1234, 5678
+
+	root := t.TempDir()
+	src := filepath.Join(root, "src")
+	writeFile(t, filepath.Join(src, "file"), "x")
+
+	for _, path := range []string{src, filepath.Join(src, "file")} {
+		err := os.Chown(path, uid, gid)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		copy func(dst string) error
+		// paths are the copies below dst whose owner is checked.
+		paths []string
+	}{
+		{
+			name: "file",
+			copy: func(dst string) error {
+				return CopyFileWithOwner(filepath.Join(src, "file"), dst, false)
+			},
+			paths: []string{""},
+		},
+		{
+			name: "dir",
+			copy: func(dst string) error {
+				return CopyDirWithOptions(src, dst, CopyDirOptions{PreserveOwner: true})
+			},
+			paths: []string{"", "file"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := filepath.Join(t.TempDir(), "dst")
+
+			err := tt.copy(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, path := range tt.paths {
+				fi, err := os.Stat(filepath.Join(dst, path))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				st := fi.Sys().(*syscall.Stat_t)
+				if st.Uid != uid || st.Gid != gid {
+					t.Errorf("%s is owned by %d:%d, want %d:%d", filepath.Join(dst, path), st.Uid, st.Gid, uid, gid)
+				}
+			}
+		})
+	}
+}
@@ -1,7 +1,11 @@
 package fhandler
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"errors"
+	"hash"
 	"io"
 	"io/fs"
 	"os"
@@ -14,37 +18,45 @@ var (
 	ErrSourceDir = errors.New("source is not a directory")
 	// ErrDestinationExists for when destination already exists.
 	ErrDestinationExists = errors.New("destination already exists")
+	// ErrChecksumMismatch for when the copied file differs from the source.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
 )
 
+// syncDir flushes the directory entries of dir to stable storage. It is
+// replaced by tests counting the syncs.
+var syncDir = fsyncDir
+
 func Rename(src, dst string) error {
 	err := os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+
 	// cross device move
-	if err != nil && strings.HasSuffix(err.Error(), "invalid cross-device link") {
-		fileInfo, err := os.Stat(src)
+	if !strings.HasSuffix(err.Error(), "invalid cross-device link") {
+		return err
+	}
+
+	fileInfo, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	if fileInfo.IsDir() {
+		err = CopyDirWithOptions(src, dst, CopyDirOptions{Sync: true})
 		if err != nil {
 			return err
 		}
 
-		if fileInfo.IsDir() {
-			if err := CopyDir(src, dst); err != nil {
-				return err
-			}
-
-			if err := os.RemoveAll(src); err != nil {
-				return err
-			}
-		} else {
-			if err := CopyFile(src, dst); err != nil {
-				return err
-			}
+		return os.RemoveAll(src)
+	}
 
-			if err := os.Remove(src); err != nil {
-				return err
-			}
-		}
+	err = CopyFile(src, dst)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	return os.Remove(src)
 }
 
 // CopyFile copies the contents of the file named src to the file named
@@ -52,71 +64,468 @@ func Rename(src, dst string) error {
 // destination file exists, all it's contents will be replaced by the contents
 // of the source file. The file mode will be copied from the source and
 // the copied data is synced/flushed to stable storage.
-func CopyFile(src, dst string) (err error) {
-	input, err := os.Open(src)
+func CopyFile(src, dst string) error {
+	return copyFile(src, dst, copyOptions{})
+}
+
+// CopyFileN copies the file like CopyFile and returns the number of bytes
+// written to dst, which callers can compare with the size of src.
+func CopyFileN(src, dst string) (int64, error) {
+	return copyFileN(src, dst, copyOptions{})
+}
+
+// CopyFileNoClobber copies the file like CopyFile, but returns
+// ErrDestinationExists if dst already exists instead of replacing it. If
+// the copy fails after dst was created, the partial dst is removed.
+func CopyFileNoClobber(src, dst string) error {
+	return copyFile(src, dst, copyOptions{noClobber: true})
+}
+
+// CopyFileBuffered copies the file like CopyFile using a buffer of
+// bufSize bytes. bufSize is capped at maxCopyBufferSize; if it is not
+// positive, the default buffer of io.Copy is used.
+func CopyFileBuffered(src, dst string, bufSize int) error {
+	return copyFile(src, dst, copyOptions{bufSize: bufSize})
+}
+
+// CopyFileProgress copies the file like CopyFile and calls progress with
+// the number of bytes copied so far and the size of src after every
+// written chunk. progress is called from the copying goroutine and may be
+// nil.
+func CopyFileProgress(src, dst string, progress func(copied, total int64)) error {
+	return copyFile(src, dst, copyOptions{progress: progress})
+}
+
+// CopyFileWithOwner copies the file like CopyFile and additionally sets
+// the owner and group of dst to the ones of src. With bestEffort set, a
+// missing privilege to change the owner is ignored. On platforms without
+// Unix ownership the owner is left unchanged.
+func CopyFileWithOwner(src, dst string, bestEffort bool) error {
+	return copyFile(src, dst, copyOptions{preserveOwner: true, bestEffort: bestEffort})
+}
+
+// CopyFileWithXattrs copies the file like CopyFile and additionally
+// copies its extended attributes, such as SELinux labels, on Linux. All
+// attributes are tried and the failed ones are returned as joined error,
+// unless bestEffort is set. On other platforms no attributes are copied.
+func CopyFileWithXattrs(src, dst string, bestEffort bool) error {
+	return copyFile(src, dst, copyOptions{xattrs: true, bestEffort: bestEffort})
+}
+
+// CopyFileSparse copies the file like CopyFile, but keeps the holes of a
+// sparse src on Linux, so dst takes no more space than src. On other
+// platforms and file systems without hole detection it copies densely.
+// The returned count is the number of bytes written, not the file size.
+func CopyFileSparse(src, dst string) (int64, error) {
+	return copyFileN(src, dst, copyOptions{sparse: true})
+}
+
+// CopyFileCtx copies the file like CopyFile, but stops as soon as ctx is
+// done. In that case the partially written dst is removed and ctx.Err()
+// is returned.
+func CopyFileCtx(ctx context.Context, src, dst string) error {
+	return copyFile(src, dst, copyOptions{ctx: ctx})
+}
+
+// CopyFileVerify copies the file like CopyFile and verifies the copy by
+// comparing the SHA-256 of src with the one of dst read back from disk.
+// ErrChecksumMismatch is returned if they differ.
+func CopyFileVerify(src, dst string) error {
+	return CopyFileVerifyHash(src, dst, sha256.New)
+}
+
+// CopyFileVerifyHash is CopyFileVerify with the hash created by newHash.
+// The source hash is computed while copying, so src is only read once.
+func CopyFileVerifyHash(src, dst string, newHash func() hash.Hash) error {
+	srcHash := newHash()
+
+	err := copyFile(src, dst, copyOptions{hash: srcHash})
 	if err != nil {
 		return err
 	}
 
-	defer input.Close()
+	output, err := os.Open(dst)
+	if err != nil {
+		return err
+	}
+
+	defer output.Close()
+
+	dstHash := newHash()
 
-	output, err := os.Create(dst)
+	_, err = io.Copy(dstHash, output)
 	if err != nil {
 		return err
 	}
 
+	if !bytes.Equal(srcHash.Sum(nil), dstHash.Sum(nil)) {
+		return ErrChecksumMismatch
+	}
+
+	return nil
+}
+
+// copyChunkSize is the number of bytes copied between two checks of the
+// context.
+const copyChunkSize = 1 << 20
+
+// maxCopyBufferSize is the largest buffer CopyFileBuffered allocates.
+const maxCopyBufferSize = 64 << 20
+
+// copyOptions configures copyFile.
+type copyOptions struct {
+	progress      func(copied, total int64)
+	ctx           context.Context
+	preserveTimes bool
+	preserveOwner bool
+	bestEffort    bool
+	hash          hash.Hash
+	noClobber     bool
+	bufSize       int
+	xattrs        bool
+	sparse        bool
+}
+
+func copyFile(src, dst string, opts copyOptions) error {
+	_, err := copyFileN(src, dst, opts)
+
+	return err
+}
+
+// copyFileN copies src to dst configured by opts and returns the number
+// of bytes written.
+func copyFileN(src, dst string, opts copyOptions) (n int64, err error) {
+	input, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+
+	defer input.Close()
+
+	si, err := input.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	flags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if opts.noClobber {
+		flags = os.O_RDWR | os.O_CREATE | os.O_EXCL
+	}
+
+	output, err := os.OpenFile(dst, flags, 0666)
+	if err != nil {
+		if opts.noClobber && errors.Is(err, fs.ErrExist) {
+			return 0, ErrDestinationExists
+		}
+
+		return 0, err
+	}
+
 	defer func() {
 		if e := output.Close(); e != nil {
 			err = e
 		}
+
+		// dst was created by this call, so nothing of value is lost
+		if err != nil && opts.noClobber {
+			os.Remove(dst)
+		}
 	}()
 
-	_, err = io.Copy(output, input)
-	if err != nil {
-		return err
+	var w io.Writer = output
+	if opts.progress != nil {
+		w = &progressWriter{w: w, total: si.Size(), progress: opts.progress}
 	}
 
-	err = output.Sync()
-	if err != nil {
-		return err
+	if opts.hash != nil {
+		w = io.MultiWriter(w, opts.hash)
+	}
+
+	if opts.ctx != nil {
+		n, err = copyContext(opts.ctx, w, input)
+		if err != nil {
+			if opts.ctx.Err() != nil {
+				os.Remove(dst)
+			}
+
+			return n, err
+		}
+	} else if opts.sparse {
+		n, err = copySparse(output, input, si.Size())
+		if err != nil {
+			return n, err
+		}
+	} else if opts.bufSize > 0 {
+		buf := make([]byte, min(opts.bufSize, maxCopyBufferSize))
+
+		// hide WriteTo and ReadFrom of *os.File, which would ignore buf
+		n, err = io.CopyBuffer(struct{ io.Writer }{w}, struct{ io.Reader }{input}, buf)
+		if err != nil {
+			return n, err
+		}
+	} else {
+		n, err = io.Copy(w, input)
+		if err != nil {
+			return n, err
+		}
 	}
 
-	si, err := os.Stat(src)
+	err = output.Sync()
 	if err != nil {
-		return err
+		return n, err
 	}
 
 	err = os.Chmod(dst, si.Mode())
 	if err != nil {
-		return err
+		return n, err
 	}
 
-	return nil
+	if opts.preserveOwner {
+		err = copyOwner(dst, si, opts.bestEffort)
+		if err != nil {
+			return n, err
+		}
+	}
+
+	if opts.xattrs {
+		err = copyXattrs(src, dst)
+		if err != nil && !opts.bestEffort {
+			return n, err
+		}
+	}
+
+	if opts.preserveTimes {
+		return n, os.Chtimes(dst, atime(si), si.ModTime())
+	}
+
+	return n, nil
+}
+
+// copyOwner sets the owner and group of dst to the ones of fi. With
+// bestEffort set, permission errors are ignored.
+func copyOwner(dst string, fi os.FileInfo, bestEffort bool) error {
+	err := chown(dst, fi)
+	if err != nil && bestEffort && errors.Is(err, fs.ErrPermission) {
+		return nil
+	}
+
+	return err
+}
+
+// copyContext copies r to w in chunks of copyChunkSize and checks ctx
+// before every chunk. It returns the number of bytes copied.
+func copyContext(ctx context.Context, w io.Writer, r io.Reader) (int64, error) {
+	var copied int64
+
+	for {
+		err := ctx.Err()
+		if err != nil {
+			return copied, err
+		}
+
+		n, err := io.CopyN(w, r, copyChunkSize)
+		copied += n
+
+		if errors.Is(err, io.EOF) {
+			return copied, nil
+		}
+
+		if err != nil {
+			return copied, err
+		}
+	}
+}
+
+// progressWriter reports the number of bytes written to w.
+type progressWriter struct {
+	w        io.Writer
+	copied   int64
+	total    int64
+	progress func(copied, total int64)
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.copied += int64(n)
+	p.progress(p.copied, p.total)
+
+	return n, err
+}
+
+// LinkOrCopyFile creates dst as hard link of src and falls back to
+// CopyFile if linking fails, e.g. across devices. A hard link shares the
+// inode with src: the content, mode and owner are the same file, so later
+// changes through one path are visible through the other.
+func LinkOrCopyFile(src, dst string) error {
+	err := os.Link(src, dst)
+	if err == nil {
+		return nil
+	}
+
+	return CopyFile(src, dst)
+}
+
+// CopyFileWithTimes copies the file like CopyFile and additionally sets the
+// access and modification times of dst to the ones of src. If the access
+// time is not available on the platform, the modification time is used
+// for both.
+func CopyFileWithTimes(src, dst string) error {
+	return copyFile(src, dst, copyOptions{preserveTimes: true})
+}
+
+// SymlinkMode defines how CopyDirWithOptions handles symlinks.
+type SymlinkMode int
+
+const (
+	// SymlinkSkip ignores symlinks.
+	SymlinkSkip SymlinkMode = iota
+	// SymlinkRecreate creates a symlink with the same, possibly relative,
+	// target in the destination.
+	SymlinkRecreate
+	// SymlinkDereference copies the file or directory the symlink points to.
+	SymlinkDereference
+)
+
+// CopyDirOptions configures CopyDirWithOptions. The zero value behaves
+// like CopyDir.
+type CopyDirOptions struct {
+	// SymlinkMode defines how symlinks are handled.
+	SymlinkMode SymlinkMode
+	// PreserveTimes copies the files with CopyFileWithTimes.
+	PreserveTimes bool
+	// PreserveOwner copies the owner and group of files and directories.
+	PreserveOwner bool
+	// BestEffort ignores missing privileges to change the owner.
+	BestEffort bool
+	// Skip is called with the source path of every entry before it is
+	// copied. If it returns true, the entry and for directories the whole
+	// subtree is skipped.
+	Skip func(path string, entry fs.DirEntry) bool
+	// Sync fsyncs every created directory once its entries are copied and
+	// the parent of dst, so the tree structure survives a crash like the
+	// synced file contents do.
+	Sync bool
+	// Merge copies into dst even if it exists. Missing directories are
+	// created, existing files are kept unless Overwrite is set.
+	Merge bool
+	// Overwrite replaces existing files and symlinks when merging.
+	Overwrite bool
+	// Skipped is called with the destination path of every existing entry
+	// kept when merging without Overwrite. It may be nil.
+	Skipped func(path string)
+	// Copied is called with the destination path and the number of bytes
+	// written of every copied file and recreated symlink. It may be nil.
+	Copied func(path string, bytes int64)
 }
 
 // CopyDir recursively copies a directory tree, attempting to preserve permissions.
 // Source directory must exist, destination directory must *not* exist.
 // Symlinks are ignored and skipped.
 func CopyDir(src string, dst string) error {
-	src = filepath.Clean(src)
-	dst = filepath.Clean(dst)
+	return CopyDirWithOptions(src, dst, CopyDirOptions{})
+}
 
-	fileInfo, err := os.Stat(src)
+// CopyDirWithTimes copies the directory tree like CopyDir, but uses
+// CopyFileWithTimes for the files.
+func CopyDirWithTimes(src string, dst string) error {
+	return CopyDirWithOptions(src, dst, CopyDirOptions{PreserveTimes: true})
+}
+
+// CopyDirWithOptions recursively copies a directory tree like CopyDir
+// with the behavior configured by opts.
+func CopyDirWithOptions(src string, dst string, opts CopyDirOptions) error {
+	err := copyDir(context.Background(), src, dst, opts, nil)
 	if err != nil {
 		return err
 	}
 
-	if !fileInfo.IsDir() {
-		return ErrSourceDir
+	if opts.Sync {
+		return syncDir(filepath.Dir(filepath.Clean(dst)))
 	}
 
-	_, err = os.Stat(dst)
-	if err != nil && !errors.Is(err, fs.ErrNotExist) {
-		return err
-	}
+	return nil
+}
 
-	if err == nil {
-		return ErrDestinationExists
+// CopyStats summarizes what a directory copy did.
+type CopyStats struct {
+	// Files is the number of copied files and recreated symlinks.
+	Files int64
+	// Dirs is the number of copied directories, including the root.
+	Dirs int64
+	// Bytes is the number of bytes written to files.
+	Bytes int64
+	// SkippedSymlinks is the number of symlinks not copied.
+	SkippedSymlinks int64
+}
+
+// CopyDirStats copies the directory tree like CopyDir and returns what
+// was copied. On error the stats cover the part copied so far.
+func CopyDirStats(src string, dst string) (CopyStats, error) {
+	var stats CopyStats
+
+	err := copyDir(context.Background(), src, dst, CopyDirOptions{}, &stats)
+
+	return stats, err
+}
+
+// CopyEvent is sent by CopyDirChan for every copied file.
+type CopyEvent struct {
+	// Path is the destination path of the file.
+	Path  string
+	Bytes int64
+}
+
+// CopyDirChan copies the directory tree like CopyDir in a new goroutine
+// and sends a CopyEvent for every copied file. The copy waits for each
+// event to be received, so the caller must range over events until it is
+// closed, however slowly, and then receive the result of the copy from
+// the error channel, nil on success. Both channels are closed once the
+// copy is done.
+func CopyDirChan(src string, dst string) (<-chan CopyEvent, <-chan error) {
+	events := make(chan CopyEvent)
+	errc := make(chan error, 1)
+
+	go func() {
+		defer close(errc)
+
+		err := CopyDirWithOptions(src, dst, CopyDirOptions{
+			Copied: func(path string, bytes int64) {
+				events <- CopyEvent{Path: path, Bytes: bytes}
+			},
+		})
+
+		close(events)
+		errc <- err
+	}()
+
+	return events, errc
+}
+
+// CopyDirFilter copies the directory tree like CopyDir, but skips every
+// entry, including whole subtrees, for which skip returns true.
+func CopyDirFilter(src string, dst string, skip func(path string, entry fs.DirEntry) bool) error {
+	return CopyDirWithOptions(src, dst, CopyDirOptions{Skip: skip})
+}
+
+// CopyDirCtx copies the directory tree like CopyDir, but stops as soon as
+// ctx is done and returns ctx.Err(). The context is checked between files
+// and while copying a file with CopyFileCtx.
+func CopyDirCtx(ctx context.Context, src string, dst string) error {
+	return copyDir(ctx, src, dst, CopyDirOptions{}, nil)
+}
+
+// copyDir copies the tree src to dst and adds what it did to stats if
+// stats is not nil.
+func copyDir(ctx context.Context, src string, dst string, opts CopyDirOptions, stats *CopyStats) error {
+	src = filepath.Clean(src)
+	dst = filepath.Clean(dst)
+
+	fileInfo, err := checkCopyDir(src, dst)
+	if opts.Merge && errors.Is(err, ErrDestinationExists) {
+		fileInfo, err = checkMergeDir(src, dst)
+	}
+	if err != nil {
+		return err
 	}
 
 	err = os.MkdirAll(dst, fileInfo.Mode())
@@ -124,6 +533,17 @@ func CopyDir(src string, dst string) error {
 		return err
 	}
 
+	if stats != nil {
+		stats.Dirs++
+	}
+
+	if opts.PreserveOwner {
+		err = copyOwner(dst, fileInfo, opts.BestEffort)
+		if err != nil {
+			return err
+		}
+	}
+
 	entries, err := os.ReadDir(src)
 	if err != nil {
 		return err
@@ -133,28 +553,173 @@ func CopyDir(src string, dst string) error {
 		srcPath := filepath.Join(src, entry.Name())
 		dstPath := filepath.Join(dst, entry.Name())
 
-		if entry.IsDir() {
-			err = CopyDir(srcPath, dstPath)
+		err = ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		if opts.Skip != nil && opts.Skip(srcPath, entry) {
+			continue
+		}
+
+		err = copyEntry(ctx, srcPath, dstPath, entry, opts, stats)
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.Sync {
+		return syncDir(dst)
+	}
+
+	return nil
+}
+
+// checkCopyDir returns the FileInfo of src if src is a directory and
+// dst does not exist yet.
+func checkCopyDir(src string, dst string) (os.FileInfo, error) {
+	fileInfo, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fileInfo.IsDir() {
+		return nil, ErrSourceDir
+	}
+
+	_, err = os.Stat(dst)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	if err == nil {
+		return nil, ErrDestinationExists
+	}
+
+	return fileInfo, nil
+}
+
+// checkMergeDir returns the FileInfo of src if src and the existing dst
+// are directories.
+func checkMergeDir(src string, dst string) (os.FileInfo, error) {
+	fileInfo, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+
+	dstInfo, err := os.Stat(dst)
+	if err != nil {
+		return nil, err
+	}
+
+	if !dstInfo.IsDir() {
+		return nil, ErrDestinationExists
+	}
+
+	return fileInfo, nil
+}
+
+// mergeExisting prepares dstPath for a merge. It reports whether an
+// existing entry is kept; with Overwrite, an existing file or symlink is
+// removed instead, so a symlink is replaced rather than followed.
+// Existing directories are always merged into.
+func mergeExisting(dstPath string, opts CopyDirOptions) (bool, error) {
+	fi, err := os.Lstat(dstPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	if fi.IsDir() {
+		return false, nil
+	}
+
+	if !opts.Overwrite {
+		if opts.Skipped != nil {
+			opts.Skipped(dstPath)
+		}
+
+		return true, nil
+	}
+
+	return false, os.Remove(dstPath)
+}
+
+func copyEntry(ctx context.Context, srcPath, dstPath string, entry fs.DirEntry, opts CopyDirOptions, stats *CopyStats) error {
+	if entry.IsDir() {
+		return copyDir(ctx, srcPath, dstPath, opts, stats)
+	}
+
+	if entry.Type()&os.ModeSymlink != 0 && opts.SymlinkMode == SymlinkSkip {
+		if stats != nil {
+			stats.SkippedSymlinks++
+		}
+
+		return nil
+	}
+
+	if opts.Merge {
+		keep, err := mergeExisting(dstPath, opts)
+		if err != nil || keep {
+			return err
+		}
+	}
+
+	if entry.Type()&os.ModeSymlink != 0 {
+		switch opts.SymlinkMode {
+		case SymlinkRecreate:
+			target, err := os.Readlink(srcPath)
 			if err != nil {
 				return err
 			}
-		} else {
-			// Skip symlinks.
-			fsInfo, err := entry.Info()
+
+			err = os.Symlink(target, dstPath)
 			if err != nil {
 				return err
 			}
 
-			if fsInfo.Mode()&os.ModeSymlink != 0 {
-				continue
+			if stats != nil {
+				stats.Files++
+			}
+
+			if opts.Copied != nil {
+				opts.Copied(dstPath, 0)
 			}
 
-			err = CopyFile(srcPath, dstPath)
+			return nil
+		case SymlinkDereference:
+			fileInfo, err := os.Stat(srcPath)
 			if err != nil {
 				return err
 			}
+
+			if fileInfo.IsDir() {
+				return copyDir(ctx, srcPath, dstPath, opts, stats)
+			}
+		default:
+			return nil
 		}
 	}
 
-	return nil
+	n, err := copyFileN(srcPath, dstPath, copyOptions{
+		ctx:           ctx,
+		preserveTimes: opts.PreserveTimes,
+		preserveOwner: opts.PreserveOwner,
+		bestEffort:    opts.BestEffort,
+	})
+	if stats != nil {
+		stats.Bytes += n
+		if err == nil {
+			stats.Files++
+		}
+	}
+
+	if err == nil && opts.Copied != nil {
+		opts.Copied(dstPath, n)
+	}
+
+	return err
 }
@@ -0,0 +1,683 @@
+package fhandler
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func BenchmarkCopyFileBuffered(b *testing.B) {
+	dir := b.TempDir()
+	src := filepath.Join(dir, "src")
+
+	const size = 64 << 20
+
+	err := os.WriteFile(src, make([]byte, size), 0644)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, bufSize := range []int{0, 32 << 10, 128 << 10, 1 << 20, 4 << 20} {
+		// zero uses the default buffer of io.Copy
+		name := "default"
+		if bufSize > 0 {
+			name = strconv.Itoa(bufSize>>10) + "KiB"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(size)
+
+			dst := filepath.Join(dir, "dst")
+
+			for i := 0; i < b.N; i++ {
+				err := CopyFileBuffered(src, dst, bufSize)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// recordSyncs replaces syncDir for the test and returns the synced
+// directories.
+func recordSyncs(t *testing.T) *[]string {
+	t.Helper()
+
+	var synced []string
+
+	orig := syncDir
+	syncDir = func(dir string) error {
+		synced = append(synced, dir)
+
+		return orig(dir)
+	}
+
+	t.Cleanup(func() { syncDir = orig })
+
+	return &synced
+}
+
+func TestCopyDirSync(t *testing.T) {
+	root := t.TempDir()
+	src := filepath.Join(root, "src")
+	dst := filepath.Join(root, "out", "dst")
+
+	mkdirFile(t, filepath.Join(src, "a", "b", "file"))
+	mkdirFile(t, filepath.Join(src, "c", "file"))
+	mkdirFile(t, filepath.Join(src, "file"))
+
+	err := os.Mkdir(filepath.Dir(dst), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		sync bool
+		want []string
+	}{
+		{sync: false},
+		{
+			sync: true,
+			// every directory once its entries are copied, then the parent
+			want: []string{
+				filepath.Join(dst, "a", "b"),
+				filepath.Join(dst, "a"),
+				filepath.Join(dst, "c"),
+				dst,
+				filepath.Dir(dst),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(strconv.FormatBool(tt.sync), func(t *testing.T) {
+			synced := recordSyncs(t)
+
+			err := CopyDirWithOptions(src, dst, CopyDirOptions{Sync: tt.sync})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer os.RemoveAll(dst)
+
+			if !slices.Equal(*synced, tt.want) {
+				t.Errorf("synced %q, want %q", *synced, tt.want)
+			}
+		})
+	}
+}
+
+// writeFile creates the file path holding content and its missing parent
+// directories.
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = os.WriteFile(path, []byte(content), 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readFile returns the content of path.
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(content)
+}
+
+func TestCopyFileWithTimes(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	writeFile(t, src, "content")
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	err := os.Chtimes(src, mtime, mtime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		copy      func(src, dst string) error
+		wantMtime bool
+	}{
+		{name: "CopyFile", copy: CopyFile},
+		{name: "CopyFileWithTimes", copy: CopyFileWithTimes, wantMtime: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := filepath.Join(dir, tt.name)
+
+			err := tt.copy(src, dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fi, err := os.Stat(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := fi.ModTime().Equal(mtime); got != tt.wantMtime {
+				t.Errorf("mtime of dst is %v, want the one of src: %v", fi.ModTime(), tt.wantMtime)
+			}
+		})
+	}
+}
+
+func TestCopyDirSymlinks(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	writeFile(t, filepath.Join(src, "file"), "x")
+	writeFile(t, filepath.Join(src, "dir", "f"), "y")
+
+	for link, target := range map[string]string{"link": "file", "dirlink": "dir"} {
+		err := os.Symlink(target, filepath.Join(src, link))
+		if err != nil {
+			t.Skipf("unable to create symlinks: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		mode SymlinkMode
+		// check verifies the copy of the symlink name to target.
+		check func(t *testing.T, dst, name, target string)
+	}{
+		{
+			name: "skip",
+			mode: SymlinkSkip,
+			check: func(t *testing.T, dst, name, target string) {
+				_, err := os.Lstat(filepath.Join(dst, name))
+				if !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("%s was copied: %v", name, err)
+				}
+			},
+		},
+		{
+			name: "recreate",
+			mode: SymlinkRecreate,
+			check: func(t *testing.T, dst, name, target string) {
+				got, err := os.Readlink(filepath.Join(dst, name))
+				if err != nil || got != target {
+					t.Errorf("%s points to %q, %v, want %q", name, got, err, target)
+				}
+			},
+		},
+		{
+			name: "dereference",
+			mode: SymlinkDereference,
+			check: func(t *testing.T, dst, name, target string) {
+				path := filepath.Join(dst, name)
+
+				fi, err := os.Lstat(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if fi.Mode()&os.ModeSymlink != 0 {
+					t.Fatalf("%s is a symlink, want a copy of %s", name, target)
+				}
+
+				if fi.IsDir() {
+					path = filepath.Join(path, "f")
+					target = filepath.Join(target, "f")
+				}
+
+				if got, want := readFile(t, path), readFile(t, filepath.Join(src, target)); got != want {
+					t.Errorf("%s holds %q, want %q", path, got, want)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := filepath.Join(t.TempDir(), "dst")
+
+			err := CopyDirWithOptions(src, dst, CopyDirOptions{SymlinkMode: tt.mode})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tt.check(t, dst, "link", "file")
+			tt.check(t, dst, "dirlink", "dir")
+		})
+	}
+}
+
+func TestCopyFileProgress(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+
+	const size = 100 << 10
+
+	writeFile(t, src, strings.Repeat("x", size))
+
+	var calls []int64
+
+	err := CopyFileProgress(src, filepath.Join(dir, "dst"), func(copied, total int64) {
+		if total != size {
+			t.Errorf("progress reported total %d, want %d", total, size)
+		}
+
+		calls = append(calls, copied)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(calls) < 2 {
+		t.Fatalf("progress called %d times for %d bytes, want it per chunk", len(calls), size)
+	}
+
+	if !slices.IsSorted(calls) || calls[len(calls)-1] != size {
+		t.Errorf("progress reported %v, want increasing counts up to %d", calls, size)
+	}
+}
+
+func TestCopyCtx(t *testing.T) {
+	root := t.TempDir()
+	src := filepath.Join(root, "src")
+	writeFile(t, filepath.Join(src, "file"), "x")
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		copy    func(ctx context.Context, src, dst string) error
+		src     string
+		wantErr error
+	}{
+		{name: "file", ctx: context.Background(), copy: CopyFileCtx, src: filepath.Join(src, "file")},
+		{name: "canceled file", ctx: canceled, copy: CopyFileCtx, src: filepath.Join(src, "file"), wantErr: context.Canceled},
+		{name: "dir", ctx: context.Background(), copy: CopyDirCtx, src: src},
+		{name: "canceled dir", ctx: canceled, copy: CopyDirCtx, src: src, wantErr: context.Canceled},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := filepath.Join(t.TempDir(), "dst")
+
+			err := tt.copy(tt.ctx, tt.src, dst)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("copy = %v, want %v", err, tt.wantErr)
+			}
+
+			file := dst
+			if tt.src == src {
+				file = filepath.Join(dst, "file")
+			}
+
+			_, err = os.Stat(file)
+			if copied := err == nil; copied != (tt.wantErr == nil) {
+				t.Errorf("file copied: %v, want %v", copied, tt.wantErr == nil)
+			}
+		})
+	}
+}
+
+func TestCopyFileVerify(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	writeFile(t, src, "content")
+
+	// every hash starts differently, like a copy read back corrupted
+	var salt byte
+
+	salted := func() hash.Hash {
+		salt++
+		h := sha256.New()
+		h.Write([]byte{salt})
+
+		return h
+	}
+
+	tests := []struct {
+		name    string
+		copy    func(src, dst string) error
+		wantErr error
+	}{
+		{name: "matching", copy: CopyFileVerify},
+		{
+			name: "mismatch",
+			copy: func(src, dst string) error {
+				return CopyFileVerifyHash(src, dst, salted)
+			},
+			wantErr: ErrChecksumMismatch,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := filepath.Join(dir, tt.name)
+
+			err := tt.copy(src, dst)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("copy = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// listTree returns the paths below root relative to it, in lexical order.
+func listTree(t *testing.T, root string) []string {
+	t.Helper()
+
+	var paths []string
+
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || path == root {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		paths = append(paths, filepath.ToSlash(rel))
+
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return paths
+}
+
+func TestCopyDirFilter(t *testing.T) {
+	root := t.TempDir()
+	src := filepath.Join(root, "src")
+	dst := filepath.Join(root, "dst")
+
+	for _, name := range []string{"keep", "drop.tmp", "cache/keep", "sub/keep", "sub/drop.tmp"} {
+		writeFile(t, filepath.Join(src, name), name)
+	}
+
+	var seen []string
+
+	err := CopyDirFilter(src, dst, func(path string, entry fs.DirEntry) bool {
+		seen = append(seen, path)
+
+		return strings.HasSuffix(path, ".tmp") || (entry.IsDir() && entry.Name() == "cache")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"keep", "sub", "sub/keep"}
+	if got := listTree(t, dst); !slices.Equal(got, want) {
+		t.Errorf("copied %q, want %q", got, want)
+	}
+
+	// the skipped subtree is not visited
+	if slices.Contains(seen, filepath.Join(src, "cache", "keep")) {
+		t.Error("skip was called for an entry of a skipped directory")
+	}
+}
+
+func TestLinkOrCopyFile(t *testing.T) {
+	tests := []struct {
+		name string
+		// existing makes the link fail.
+		existing bool
+		wantLink bool
+	}{
+		{name: "link", wantLink: true},
+		{name: "copy when linking fails", existing: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			src := filepath.Join(dir, "src")
+			dst := filepath.Join(dir, "dst")
+			writeFile(t, src, "content")
+
+			if tt.existing {
+				writeFile(t, dst, "old")
+			}
+
+			err := LinkOrCopyFile(src, dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := readFile(t, dst); got != "content" {
+				t.Errorf("dst holds %q, want %q", got, "content")
+			}
+
+			srcInfo, err := os.Stat(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dstInfo, err := os.Stat(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := os.SameFile(srcInfo, dstInfo); got != tt.wantLink {
+				t.Errorf("dst is a hard link of src: %v, want %v", got, tt.wantLink)
+			}
+		})
+	}
+}
+
+func TestCopyFileNoClobber(t *testing.T) {
+	tests := []struct {
+		name    string
+		old     string
+		dirSrc  bool
+		wantErr error
+		// want is the content of dst afterwards, empty if it must not
+		// exist.
+		want string
+	}{
+		{name: "missing dst", want: "content"},
+		{name: "existing dst", old: "old", wantErr: ErrDestinationExists, want: "old"},
+		// reading a directory fails after dst was created
+		{name: "failed copy", dirSrc: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			src := filepath.Join(dir, "src")
+			dst := filepath.Join(dir, "dst")
+
+			if tt.dirSrc {
+				mkdirFile(t, filepath.Join(src, "file"))
+			} else {
+				writeFile(t, src, "content")
+			}
+
+			if tt.old != "" {
+				writeFile(t, dst, tt.old)
+			}
+
+			err := CopyFileNoClobber(src, dst)
+			if tt.dirSrc {
+				if err == nil {
+					t.Fatal("CopyFileNoClobber() of a directory succeeded")
+				}
+			} else if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("CopyFileNoClobber() = %v, want %v", err, tt.wantErr)
+			}
+
+			if tt.want == "" {
+				_, err = os.Stat(dst)
+				if !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("partial dst was left behind: %v", err)
+				}
+
+				return
+			}
+
+			if got := readFile(t, dst); got != tt.want {
+				t.Errorf("dst holds %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCopyDirMerge(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "src")
+	writeFile(t, filepath.Join(src, "existing"), "new")
+	writeFile(t, filepath.Join(src, "sub", "added"), "added")
+
+	tests := []struct {
+		name         string
+		opts         CopyDirOptions
+		wantErr      error
+		wantExisting string
+		wantSkipped  []string
+	}{
+		{name: "no merge", wantErr: ErrDestinationExists, wantExisting: "old"},
+		{name: "merge", opts: CopyDirOptions{Merge: true}, wantExisting: "old", wantSkipped: []string{"existing"}},
+		{name: "overwrite", opts: CopyDirOptions{Merge: true, Overwrite: true}, wantExisting: "new"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := filepath.Join(t.TempDir(), "dst")
+			writeFile(t, filepath.Join(dst, "existing"), "old")
+			writeFile(t, filepath.Join(dst, "sub", "kept"), "kept")
+
+			var skipped []string
+
+			tt.opts.Skipped = func(path string) {
+				rel, _ := filepath.Rel(dst, path)
+				skipped = append(skipped, rel)
+			}
+
+			err := CopyDirWithOptions(src, dst, tt.opts)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("CopyDirWithOptions() = %v, want %v", err, tt.wantErr)
+			}
+
+			if got := readFile(t, filepath.Join(dst, "existing")); got != tt.wantExisting {
+				t.Errorf("existing holds %q, want %q", got, tt.wantExisting)
+			}
+
+			if !slices.Equal(skipped, tt.wantSkipped) {
+				t.Errorf("skipped %q, want %q", skipped, tt.wantSkipped)
+			}
+
+			if tt.wantErr != nil {
+				return
+			}
+
+			want := []string{"existing", "sub", "sub/added", "sub/kept"}
+			if got := listTree(t, dst); !slices.Equal(got, want) {
+				t.Errorf("dst holds %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestCopyFileN(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+
+	for _, size := range []int{0, 1, 100 << 10} {
+		t.Run(strconv.Itoa(size), func(t *testing.T) {
+			writeFile(t, src, strings.Repeat("x", size))
+
+			n, err := CopyFileN(src, filepath.Join(dir, "dst"))
+			if err != nil || n != int64(size) {
+				t.Errorf("CopyFileN() = %d, %v, want %d, nil", n, err, size)
+			}
+		})
+	}
+}
+
+func TestCopyDirStats(t *testing.T) {
+	root := t.TempDir()
+	src := filepath.Join(root, "src")
+	writeFile(t, filepath.Join(src, "a"), "abc")
+	writeFile(t, filepath.Join(src, "sub", "b"), "de")
+	writeFile(t, filepath.Join(src, "sub", "deep", "c"), "")
+
+	want := CopyStats{Files: 3, Dirs: 3, Bytes: 5}
+
+	if os.Symlink("a", filepath.Join(src, "link")) == nil {
+		want.SkippedSymlinks = 1
+	}
+
+	stats, err := CopyDirStats(src, filepath.Join(root, "dst"))
+	if err != nil || stats != want {
+		t.Errorf("CopyDirStats() = %+v, %v, want %+v, nil", stats, err, want)
+	}
+}
+
+func TestCopyDirChan(t *testing.T) {
+	root := t.TempDir()
+	src := filepath.Join(root, "src")
+	dst := filepath.Join(root, "dst")
+	writeFile(t, filepath.Join(src, "a"), "abc")
+	writeFile(t, filepath.Join(src, "sub", "b"), "de")
+
+	tests := []struct {
+		name       string
+		wantEvents []CopyEvent
+		wantErr    error
+	}{
+		{
+			name: "copy",
+			wantEvents: []CopyEvent{
+				{Path: filepath.Join(dst, "a"), Bytes: 3},
+				{Path: filepath.Join(dst, "sub", "b"), Bytes: 2},
+			},
+		},
+		// dst exists after the first copy
+		{name: "existing dst", wantErr: ErrDestinationExists},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, errc := CopyDirChan(src, dst)
+
+			var got []CopyEvent
+
+			for event := range events {
+				// the copy waits for a slow receiver
+				time.Sleep(time.Millisecond)
+
+				got = append(got, event)
+			}
+
+			err := <-errc
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("copy error = %v, want %v", err, tt.wantErr)
+			}
+
+			if !slices.Equal(got, tt.wantEvents) {
+				t.Errorf("events = %v, want %v", got, tt.wantEvents)
+			}
+
+			if _, ok := <-errc; ok {
+				t.Error("error channel not closed")
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package fhandler
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// CopyDirParallel copies a directory tree like CopyDir, but copies the
+// files with up to workers goroutines. The directory tree is created
+// before any file is copied. The first error stops the remaining copies
+// and is returned.
+func CopyDirParallel(src string, dst string, workers int) error {
+	if workers < 1 {
+		workers = 1
+	}
+
+	src = filepath.Clean(src)
+	dst = filepath.Clean(dst)
+
+	_, err := checkCopyDir(src, dst)
+	if err != nil {
+		return err
+	}
+
+	files, err := createTree(src, dst)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+
+	jobs := make(chan copyJob)
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for job := range jobs {
+				err := copyFile(job.src, job.dst, copyOptions{ctx: ctx})
+				if err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, job := range files {
+		select {
+		case jobs <- job:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+
+	close(jobs)
+	wg.Wait()
+
+	return firstErr
+}
+
+// copyJob is a file to copy.
+type copyJob struct {
+	src string
+	dst string
+}
+
+// createTree creates the directories of src below dst and returns the
+// files to copy. Symlinks are skipped.
+func createTree(src string, dst string) ([]copyJob, error) {
+	var files []copyJob
+
+	err := filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dst, rel)
+
+		if entry.IsDir() {
+			fsInfo, err := entry.Info()
+			if err != nil {
+				return err
+			}
+
+			return os.MkdirAll(target, fsInfo.Mode())
+		}
+
+		if entry.Type()&os.ModeSymlink != 0 {
+			return nil
+		}
+
+		files = append(files, copyJob{src: path, dst: target})
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
@@ -0,0 +1,64 @@
+package fhandler
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// makeTree creates a fixture tree of dirs directories holding files
+// files of size bytes each below root.
+func makeTree(b *testing.B, root string, dirs, files, size int) {
+	b.Helper()
+
+	content := make([]byte, size)
+
+	for d := range dirs {
+		dir := filepath.Join(root, fmt.Sprintf("d%d", d), "sub")
+
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		for f := range files {
+			err = os.WriteFile(filepath.Join(dir, fmt.Sprintf("f%d", f)), content, 0644)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkCopyDir(b *testing.B) {
+	src := filepath.Join(b.TempDir(), "src")
+	makeTree(b, src, 20, 50, 4096)
+
+	benchmarks := []struct {
+		name string
+		copy func(src, dst string) error
+	}{
+		{name: "serial", copy: CopyDir},
+		{name: "parallel-1", copy: func(src, dst string) error { return CopyDirParallel(src, dst, 1) }},
+		{name: "parallel-4", copy: func(src, dst string) error { return CopyDirParallel(src, dst, 4) }},
+		{name: "parallel-16", copy: func(src, dst string) error { return CopyDirParallel(src, dst, 16) }},
+	}
+
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			dst := filepath.Join(b.TempDir(), "dst")
+
+			for i := 0; i < b.N; i++ {
+				err := bm.copy(src, dst)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				b.StopTimer()
+				os.RemoveAll(dst)
+				b.StartTimer()
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package fhandler
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// CopyAction is the operation CopyDir performs for an entry.
+type CopyAction int
+
+const (
+	// CopyActionMkdir creates a directory.
+	CopyActionMkdir CopyAction = iota
+	// CopyActionCopy copies a file.
+	CopyActionCopy
+	// CopyActionSkipSymlink skips a symlink.
+	CopyActionSkipSymlink
+)
+
+func (a CopyAction) String() string {
+	switch a {
+	case CopyActionMkdir:
+		return "mkdir"
+	case CopyActionCopy:
+		return "copy"
+	case CopyActionSkipSymlink:
+		return "skip-symlink"
+	default:
+		return "unknown"
+	}
+}
+
+// CopyOp is an operation planned by CopyDirPlan. Size is the number of
+// bytes to copy and zero for directories and symlinks.
+type CopyOp struct {
+	Src    string
+	Dst    string
+	Size   int64
+	Action CopyAction
+}
+
+// CopyDirPlan returns the operations CopyDir would perform to copy src to
+// dst in the order they would happen, without touching dst. It returns
+// the same errors as CopyDir for an invalid source or an existing
+// destination.
+func CopyDirPlan(src string, dst string) ([]CopyOp, error) {
+	src = filepath.Clean(src)
+	dst = filepath.Clean(dst)
+
+	_, err := checkCopyDir(src, dst)
+	if err != nil {
+		return nil, err
+	}
+
+	var ops []CopyOp
+
+	err = filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		op := CopyOp{Src: path, Dst: filepath.Join(dst, rel)}
+
+		switch {
+		case entry.IsDir():
+			op.Action = CopyActionMkdir
+		case entry.Type()&os.ModeSymlink != 0:
+			op.Action = CopyActionSkipSymlink
+		default:
+			fsInfo, err := entry.Info()
+			if err != nil {
+				return err
+			}
+
+			op.Action = CopyActionCopy
+			op.Size = fsInfo.Size()
+		}
+
+		ops = append(ops, op)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ops, nil
+}
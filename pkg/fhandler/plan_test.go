@@ -0,0 +1,49 @@
+package fhandler
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestCopyDirPlan(t *testing.T) {
+	root := t.TempDir()
+	src := filepath.Join(root, "src")
+	dst := filepath.Join(root, "dst")
+
+	writeFile(t, filepath.Join(src, "a", "file"), "abc")
+	writeFile(t, filepath.Join(src, "b"), "")
+
+	want := []CopyOp{
+		{Src: src, Dst: dst, Action: CopyActionMkdir},
+		{Src: filepath.Join(src, "a"), Dst: filepath.Join(dst, "a"), Action: CopyActionMkdir},
+		{Src: filepath.Join(src, "a", "file"), Dst: filepath.Join(dst, "a", "file"), Size: 3, Action: CopyActionCopy},
+		{Src: filepath.Join(src, "b"), Dst: filepath.Join(dst, "b"), Action: CopyActionCopy},
+	}
+
+	err := os.Symlink("b", filepath.Join(src, "c"))
+	if err == nil {
+		want = append(want, CopyOp{Src: filepath.Join(src, "c"), Dst: filepath.Join(dst, "c"), Action: CopyActionSkipSymlink})
+	}
+
+	ops, err := CopyDirPlan(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(ops, want) {
+		t.Errorf("CopyDirPlan() = %v, want %v", ops, want)
+	}
+
+	_, err = os.Stat(dst)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("CopyDirPlan touched dst: %v", err)
+	}
+
+	_, err = CopyDirPlan(src, root)
+	if !errors.Is(err, ErrDestinationExists) {
+		t.Errorf("CopyDirPlan() to an existing dst = %v, want %v", err, ErrDestinationExists)
+	}
+}
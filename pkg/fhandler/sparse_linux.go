@@ -0,0 +1,64 @@
+//go:build linux
+// +build linux
+
+package fhandler
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// copySparse copies the data regions of src to dst and leaves the holes
+// unwritten, so dst stays sparse. It returns the number of bytes written.
+// If the file system of src cannot report holes, the file is copied
+// densely.
+func copySparse(dst, src *os.File, size int64) (int64, error) {
+	var written int64
+
+	for offset := int64(0); offset < size; {
+		data, err := src.Seek(offset, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			// only a hole is left
+			break
+		}
+
+		if errors.Is(err, syscall.EINVAL) && offset == 0 {
+			return io.Copy(dst, src)
+		}
+
+		if err != nil {
+			return written, err
+		}
+
+		hole, err := src.Seek(data, seekHole)
+		if err != nil {
+			return written, err
+		}
+
+		_, err = src.Seek(data, io.SeekStart)
+		if err == nil {
+			_, err = dst.Seek(data, io.SeekStart)
+		}
+		if err != nil {
+			return written, err
+		}
+
+		n, err := io.CopyN(dst, src, hole-data)
+		written += n
+
+		if err != nil {
+			return written, err
+		}
+
+		offset = hole
+	}
+
+	return written, dst.Truncate(size)
+}
@@ -0,0 +1,83 @@
+//go:build linux
+// +build linux
+
+package fhandler
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// allocated returns the number of bytes allocated for path on disk.
+func allocated(t *testing.T, path string) int64 {
+	t.Helper()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fi.Sys().(*syscall.Stat_t).Blocks * 512
+}
+
+func TestCopyFileSparse(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+
+	const size = 8 << 20
+
+	f, err := os.Create(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = f.WriteAt([]byte("data"), size/2)
+	if err == nil {
+		err = f.Truncate(size)
+	}
+
+	cerr := f.Close()
+	if err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if allocated(t, src) >= size {
+		t.Skip("file system without sparse files")
+	}
+
+	n, err := CopyFileSparse(src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only the data region is written
+	if n >= size {
+		t.Errorf("CopyFileSparse() wrote %d bytes, want less than the size %d", n, size)
+	}
+
+	want, err := os.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Error("dst differs from src")
+	}
+
+	if a := allocated(t, dst); a >= size {
+		t.Errorf("dst allocates %d bytes, want less than the size %d", a, size)
+	}
+}
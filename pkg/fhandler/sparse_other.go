@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package fhandler
+
+import (
+	"io"
+	"os"
+)
+
+// copySparse copies src to dst densely, holes are only detected on Linux.
+func copySparse(dst, src *os.File, size int64) (int64, error) {
+	return io.Copy(dst, src)
+}
@@ -0,0 +1,20 @@
+//go:build !windows
+// +build !windows
+
+package fhandler
+
+import (
+	"os"
+)
+
+// fsyncDir flushes the directory entries of dir to stable storage.
+func fsyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	defer d.Close()
+
+	return d.Sync()
+}
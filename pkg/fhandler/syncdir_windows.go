@@ -0,0 +1,10 @@
+//go:build windows
+// +build windows
+
+package fhandler
+
+// fsyncDir does nothing, Windows cannot flush a directory handle and
+// persists renames with the metadata of the file system.
+func fsyncDir(dir string) error {
+	return nil
+}
@@ -1,7 +1,14 @@
 package fhandler
 
 import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"math/rand/v2"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 )
 
@@ -9,22 +16,83 @@ func WriteAtomicTmpDir(prefix string, file string, content []byte, permission os
 	return WriteAtomic(os.TempDir(), prefix, file, content, permission)
 }
 
+// WriteAtomic writes content to a temporary file in dir and moves it to
+// file afterwards. The parent directory of file is synced after the move,
+// so the write is only durable once WriteAtomic returns without error.
+// If dir is empty, the temporary file is created next to file, so the
+// move is an atomic rename on the same device.
 func WriteAtomic(dir string, prefix string, file string, content []byte, permission os.FileMode) error {
-	tmpName, err := writeTmpFile(dir, prefix, content)
+	return WriteAtomicReader(dir, prefix, file, bytes.NewReader(content), permission)
+}
+
+// WriteAtomicReader is WriteAtomic with the content streamed from r
+// instead of being held in memory.
+func WriteAtomicReader(dir string, prefix string, file string, r io.Reader, permission os.FileMode) error {
+	return writeAtomic(dir, prefix, file, r, permission, "")
+}
+
+// WriteAtomicBackup is WriteAtomic, but keeps the previous content of file
+// as file+backupSuffix. If moving the new content into place fails, the
+// backup is restored. An empty backupSuffix disables the backup.
+func WriteAtomicBackup(dir string, prefix string, file string, content []byte, permission os.FileMode, backupSuffix string) error {
+	return writeAtomic(dir, prefix, file, bytes.NewReader(content), permission, backupSuffix)
+}
+
+// WriteAtomicKeepMode is WriteAtomic, but if file already exists its
+// current permission is kept instead of permission, so a chmod of the
+// file survives the write.
+func WriteAtomicKeepMode(dir string, prefix string, file string, content []byte, permission os.FileMode) error {
+	fi, err := os.Stat(file)
+	if err == nil {
+		permission = fi.Mode().Perm()
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return WriteAtomic(dir, prefix, file, content, permission)
+}
+
+func writeAtomic(dir string, prefix string, file string, r io.Reader, permission os.FileMode, backupSuffix string) error {
+	if dir == "" {
+		dir = filepath.Dir(file)
+	}
+
+	tmpName, err := writeTmpFile(dir, prefix, r, permission)
 	if err != nil {
 		return err
 	}
 
-	err = os.Chmod(tmpName, permission)
+	var backup string
+
+	if backupSuffix != "" {
+		err = os.Rename(file, file+backupSuffix)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			os.Remove(tmpName)
+
+			return err
+		}
+
+		if err == nil {
+			backup = file + backupSuffix
+		}
+	}
+
+	err = Rename(tmpName, file)
 	if err != nil {
+		os.Remove(tmpName)
+
+		if backup != "" {
+			os.Rename(backup, file)
+		}
+
 		return err
 	}
 
-	return Rename(tmpName, file)
+	return syncDir(filepath.Dir(file))
 }
 
 func WriteAtomicTmp(prefix string, content []byte) (string, error) {
-	tmpName, err := writeTmpFile(os.TempDir(), prefix, content)
+	tmpName, err := writeTmpFile(os.TempDir(), prefix, bytes.NewReader(content), 0600)
 	if err != nil {
 		return "", err
 	}
@@ -32,19 +100,36 @@ func WriteAtomicTmp(prefix string, content []byte) (string, error) {
 	return tmpName, nil
 }
 
-func writeTmpFile(dir string, prefix string, content []byte) (string, error) {
+// writeTmpFile writes r to a new temporary file in dir with the given
+// permission and syncs it, so its content is durable before it is moved.
+// The file is created with permission, so it is only changed with chmod
+// if the umask removed some of its bits.
+func writeTmpFile(dir string, prefix string, r io.Reader, permission os.FileMode) (string, error) {
 	if !strings.Contains(prefix, "*") {
 		prefix = prefix + "_*"
 	}
 
-	tmpFile, err := os.CreateTemp(dir, prefix)
+	tmpFile, err := createTmpFile(dir, prefix, permission)
 	if err != nil {
 		return "", err
 	}
 
 	defer tmpFile.Close()
 
-	_, err = tmpFile.Write(content)
+	_, err = io.Copy(tmpFile, r)
+	if err != nil {
+		os.Remove(tmpFile.Name())
+
+		return "", err
+	}
+
+	fi, err := tmpFile.Stat()
+	if err == nil && fi.Mode().Perm() != permission.Perm() {
+		err = tmpFile.Chmod(permission)
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
 	if err != nil {
 		os.Remove(tmpFile.Name())
 
@@ -53,3 +138,25 @@ func writeTmpFile(dir string, prefix string, content []byte) (string, error) {
 
 	return tmpFile.Name(), nil
 }
+
+// createTmpFile is os.CreateTemp with the file created with permission
+// instead of 0600. The last "*" in pattern is replaced by a random string.
+func createTmpFile(dir string, pattern string, permission os.FileMode) (*os.File, error) {
+	prefix, suffix := pattern, ""
+	if i := strings.LastIndex(pattern, "*"); i >= 0 {
+		prefix, suffix = pattern[:i], pattern[i+1:]
+	}
+
+	for range 10000 {
+		name := filepath.Join(dir, prefix+strconv.FormatUint(uint64(rand.Uint32()), 10)+suffix)
+
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, permission)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+
+		return f, err
+	}
+
+	return nil, &fs.PathError{Op: "createtemp", Path: filepath.Join(dir, pattern), Err: fs.ErrExist}
+}
@@ -0,0 +1,195 @@
+package fhandler
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+var errRead = errors.New("read failed")
+
+func TestWriteAtomicRemovesTmpFileOnError(t *testing.T) {
+	tests := []struct {
+		name string
+		// target returns the file to write in the directory root.
+		target func(t *testing.T, root string) string
+		r      io.Reader
+	}{
+		{
+			name: "rename onto a non-empty directory",
+			target: func(t *testing.T, root string) string {
+				dir := filepath.Join(root, "target")
+				mkdirFile(t, filepath.Join(dir, "child"))
+
+				return dir
+			},
+			r: bytes.NewReader([]byte("1")),
+		},
+		{
+			name: "missing target directory",
+			target: func(t *testing.T, root string) string {
+				return filepath.Join(root, "missing", "target")
+			},
+			r: bytes.NewReader([]byte("1")),
+		},
+		{
+			name: "failing reader",
+			target: func(t *testing.T, root string) string {
+				return filepath.Join(root, "target")
+			},
+			r: iotest.ErrReader(errRead),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			file := tt.target(t, t.TempDir())
+
+			err := WriteAtomicReader(tmpDir, ".test", file, tt.r, 0644)
+			if err == nil {
+				t.Fatal("WriteAtomicReader succeeded, want error")
+			}
+
+			entries, err := os.ReadDir(tmpDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, entry := range entries {
+				t.Errorf("temporary file %s left behind", entry.Name())
+			}
+		})
+	}
+}
+
+// mkdirFile creates the file path and its missing parent directories.
+func mkdirFile(t *testing.T, path string) {
+	t.Helper()
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = os.WriteFile(path, nil, 0644)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteAtomicReader(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "target")
+	writeFile(t, file, "old")
+
+	err := WriteAtomicReader("", ".test", file, iotest.OneByteReader(strings.NewReader("new content")), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readFile(t, file); got != "new content" {
+		t.Errorf("file holds %q, want %q", got, "new content")
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 {
+		t.Errorf("directory holds %d entries, want only the target", len(entries))
+	}
+}
+
+func TestWriteAtomicBackup(t *testing.T) {
+	tests := []struct {
+		name        string
+		old         string
+		suffix      string
+		wantEntries []string
+	}{
+		{name: "existing file", old: "old", suffix: ".bak", wantEntries: []string{"target", "target.bak"}},
+		{name: "missing file", suffix: ".bak", wantEntries: []string{"target"}},
+		{name: "disabled", old: "old", wantEntries: []string{"target"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			file := filepath.Join(dir, "target")
+
+			if tt.old != "" {
+				writeFile(t, file, tt.old)
+			}
+
+			err := WriteAtomicBackup("", ".test", file, []byte("new"), 0644, tt.suffix)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := readFile(t, file); got != "new" {
+				t.Errorf("file holds %q, want %q", got, "new")
+			}
+
+			if got := listTree(t, dir); !slices.Equal(got, tt.wantEntries) {
+				t.Fatalf("directory holds %q, want %q", got, tt.wantEntries)
+			}
+
+			if len(tt.wantEntries) > 1 {
+				if got := readFile(t, file+tt.suffix); got != tt.old {
+					t.Errorf("backup holds %q, want %q", got, tt.old)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteAtomicKeepMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows has no Unix permissions")
+	}
+
+	tests := []struct {
+		name     string
+		existing bool
+		want     os.FileMode
+	}{
+		{name: "existing file", existing: true, want: 0600},
+		{name: "missing file", want: 0644},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "target")
+
+			if tt.existing {
+				writeFile(t, file, "old")
+
+				err := os.Chmod(file, 0600)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := WriteAtomicKeepMode("", ".test", file, []byte("new"), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fi, err := os.Stat(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := fi.Mode().Perm(); got != tt.want {
+				t.Errorf("mode is %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
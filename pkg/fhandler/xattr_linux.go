@@ -0,0 +1,94 @@
+//go:build linux
+// +build linux
+
+package fhandler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// copyXattrs copies the extended attributes of src to dst. Every
+// attribute is tried, the errors of the failed ones are joined. A source
+// file system without xattr support has nothing to copy.
+func copyXattrs(src, dst string) error {
+	names, err := listXattrs(src)
+	if errors.Is(err, syscall.ENOTSUP) {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("unable to list xattrs of %s: %w", src, err)
+	}
+
+	var errs []error
+
+	for _, name := range names {
+		value, err := getXattr(src, name)
+		if err == nil {
+			err = syscall.Setxattr(dst, name, value, 0)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to copy xattr %s: %w", name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// listXattrs returns the names of the extended attributes of path.
+func listXattrs(path string) ([]string, error) {
+	buf, err := readXattr(func(dest []byte) (int, error) {
+		return syscall.Listxattr(path, dest)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+
+	for _, name := range bytes.Split(buf, []byte{0}) {
+		if len(name) > 0 {
+			names = append(names, string(name))
+		}
+	}
+
+	return names, nil
+}
+
+// getXattr returns the value of the extended attribute name of path.
+func getXattr(path string, name string) ([]byte, error) {
+	return readXattr(func(dest []byte) (int, error) {
+		return syscall.Getxattr(path, name, dest)
+	})
+}
+
+// readXattr calls read with a buffer of the size it reports for a nil
+// buffer. ERANGE of an attribute growing in between is retried.
+func readXattr(read func(dest []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := read(nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if size == 0 {
+			return nil, nil
+		}
+
+		buf := make([]byte, size)
+
+		n, err := read(buf)
+		if errors.Is(err, syscall.ERANGE) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		return buf[:n], nil
+	}
+}
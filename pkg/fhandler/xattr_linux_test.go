@@ -0,0 +1,46 @@
+//go:build linux
+// +build linux
+
+package fhandler
+
+import (
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestCopyFileWithXattrs(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	writeFile(t, src, "content")
+
+	err := syscall.Setxattr(src, "user.test", []byte("value"), 0)
+	if err != nil {
+		t.Skipf("file system without user xattrs: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		copy func(src, dst string) error
+		want string
+	}{
+		{name: "CopyFile", copy: CopyFile},
+		{name: "CopyFileWithXattrs", copy: func(src, dst string) error { return CopyFileWithXattrs(src, dst, false) }, want: "value"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := filepath.Join(dir, tt.name)
+
+			err := tt.copy(src, dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			value, _ := getXattr(dst, "user.test")
+			if string(value) != tt.want {
+				t.Errorf("xattr of dst is %q, want %q", value, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package fhandler
+
+// copyXattrs does nothing, extended attributes are only copied on Linux.
+func copyXattrs(src, dst string) error {
+	return nil
+}
@@ -0,0 +1,149 @@
+//go:build (linux || darwin || freebsd || openbsd || netbsd || dragonfly) && go1.3
+// +build linux darwin freebsd openbsd netbsd dragonfly
+// +build go1.3
+
+package lockfile
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/matbits/counter/pkg/clock"
+)
+
+// queueSuffix is appended to Path to name the wait queue of LockWriteFair.
+const queueSuffix = ".queue"
+
+// LockWriteFair locks the file for writing like LockWriteB, but waiters
+// acquire the lock in the order they called LockWriteFair. Waiters are
+// registered with their pid in a queue file next to Path, entries of
+// processes which are no longer alive are dropped. This is cooperative
+// and best-effort: processes locking the file without LockWriteFair are
+// not queued and may still take the lock first.
+func (l *FcntlLockfile) LockWriteFair() error {
+	interval := l.RetryInterval
+	if interval <= 0 {
+		interval = DefaultRetryInterval
+	}
+
+	clk := clock.OrReal(l.Clock)
+
+	entry := fmt.Sprintf("%d %d", os.Getpid(), clk.Now().UnixNano())
+
+	queue := NewFcntlLockfile(l.Path + queueSuffix)
+
+	err := queue.updateQueue(func(entries []string) []string {
+		return append(entries, entry)
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		var (
+			acquired bool
+			lockErr  error
+		)
+
+		err = queue.updateQueue(func(entries []string) []string {
+			if !slices.Contains(entries, entry) {
+				return append(entries, entry)
+			}
+
+			if entries[0] != entry {
+				return entries
+			}
+
+			lockErr = l.LockWrite()
+			if lockErr != nil {
+				return entries
+			}
+
+			acquired = true
+
+			return entries[1:]
+		})
+		if err != nil {
+			if acquired {
+				l.Unlock()
+			}
+
+			return err
+		}
+
+		if acquired {
+			return nil
+		}
+
+		if !errors.Is(lockErr, ErrFailedToLock) && lockErr != nil {
+			queue.updateQueue(func(entries []string) []string {
+				return slices.DeleteFunc(entries, func(e string) bool { return e == entry })
+			})
+
+			return lockErr
+		}
+
+		<-clk.After(interval)
+	}
+}
+
+// updateQueue locks the queue file, passes the entries of processes which
+// are still alive to fn and writes the entries it returns back.
+func (l *FcntlLockfile) updateQueue(fn func(entries []string) []string) error {
+	err := l.LockWriteB()
+	if err != nil {
+		return err
+	}
+
+	defer l.Unlock()
+
+	content, err := io.ReadAll(l.file)
+	if err != nil {
+		return err
+	}
+
+	var entries []string
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && alive(line) {
+			entries = append(entries, line)
+		}
+	}
+
+	entries = fn(entries)
+
+	err = l.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+
+	var out []byte
+	for _, e := range entries {
+		out = append(out, e+"\n"...)
+	}
+
+	_, err = l.file.WriteAt(out, 0)
+
+	return err
+}
+
+// alive reports whether the process of a queue entry is still running.
+func alive(entry string) bool {
+	pidStr, _, _ := strings.Cut(entry, " ")
+
+	pid, err := strconv.Atoi(pidStr)
+	if err != nil {
+		return false
+	}
+
+	return processAlive(pid)
+}
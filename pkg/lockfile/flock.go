@@ -0,0 +1,149 @@
+//go:build (linux || darwin || freebsd || openbsd || netbsd || dragonfly) && go1.3
+// +build linux darwin freebsd openbsd netbsd dragonfly
+// +build go1.3
+
+package lockfile
+
+import (
+	"os"
+	"sync"
+	"syscall"
+)
+
+// FlockLockfile is a Locker backed by flock(2). Unlike fcntl locks, flock
+// locks belong to the open file description, so they are not released
+// when another descriptor of the same file is closed and are inherited
+// across fork. It is safe for concurrent use; a blocking lock call holds
+// the internal mutex until the lock is obtained, so other calls on the
+// same FlockLockfile wait for it.
+type FlockLockfile struct {
+	Path string
+	// mu guards file.
+	mu           sync.Mutex
+	file         *os.File
+	maintainFile bool
+}
+
+// NewFlockLockfile returns a lock for path. The file is opened, and
+// created if needed, by the lock and closed by Unlock.
+func NewFlockLockfile(path string) *FlockLockfile {
+	return &FlockLockfile{Path: path, maintainFile: true}
+}
+
+// NewFlockLockfileFromFile returns a lock on the already open file. The
+// file is never closed by the lock, so it can be locked and unlocked
+// repeatedly. The caller owns the file and closes it when done.
+func NewFlockLockfileFromFile(file *os.File) *FlockLockfile {
+	return &FlockLockfile{file: file, maintainFile: false}
+}
+
+func (l *FlockLockfile) LockRead() error {
+	return l.lock(syscall.LOCK_SH | syscall.LOCK_NB)
+}
+
+func (l *FlockLockfile) LockWrite() error {
+	return l.lock(syscall.LOCK_EX | syscall.LOCK_NB)
+}
+
+func (l *FlockLockfile) LockReadB() error {
+	return l.lock(syscall.LOCK_SH)
+}
+
+func (l *FlockLockfile) LockWriteB() error {
+	return l.lock(syscall.LOCK_EX)
+}
+
+// TryLockRead tries to lock the file for reading without blocking. It
+// returns false and no error if the lock is held by another process.
+func (l *FlockLockfile) TryLockRead() (bool, error) {
+	return l.tryLock(syscall.LOCK_SH | syscall.LOCK_NB)
+}
+
+// TryLockWrite tries to lock the file for writing without blocking. It
+// returns false and no error if the lock is held by another process.
+func (l *FlockLockfile) TryLockWrite() (bool, error) {
+	return l.tryLock(syscall.LOCK_EX | syscall.LOCK_NB)
+}
+
+func (l *FlockLockfile) Unlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+
+	err := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+
+	if l.maintainFile {
+		cerr := l.file.Close()
+		l.file = nil
+
+		if err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+func (l *FlockLockfile) tryLock(how int) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := l.setLock(how)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (l *FlockLockfile) lock(how int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := l.setLock(how)
+	if errno, ok := err.(syscall.Errno); ok {
+		e := &LockError{Path: l.Path, Mode: lockMode(how&syscall.LOCK_EX != 0), Pid: -1, Err: errno}
+		if e.Path == "" && l.file != nil {
+			e.Path = l.file.Name()
+		}
+
+		return e
+	}
+
+	return err
+}
+
+// setLock opens the file if required and applies the lock. Errors of
+// the flock call are returned as plain syscall.Errno. The caller must
+// hold mu.
+func (l *FlockLockfile) setLock(how int) error {
+	if l.file == nil {
+		f, err := os.OpenFile(l.Path, os.O_CREATE|os.O_RDWR, 0666)
+		if err != nil {
+			return err
+		}
+		l.file = f
+	}
+
+	err := syscall.Flock(int(l.file.Fd()), how)
+	// a blocking flock is interrupted by signals handled by the process
+	for how&syscall.LOCK_NB == 0 && err == syscall.EINTR {
+		err = syscall.Flock(int(l.file.Fd()), how)
+	}
+	if err != nil {
+		if l.maintainFile {
+			l.file.Close()
+			l.file = nil
+		}
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,16 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd || dragonfly
+// +build linux darwin freebsd openbsd netbsd dragonfly
+
+package lockfile
+
+import "testing"
+
+func init() {
+	// flock locks of separate opens conflict within the process
+	lockerKinds = append(lockerKinds, lockerKind{
+		name: "FlockLockfile",
+		open: func(t *testing.T, path string) lockerCase {
+			return otherHandle(t, NewFlockLockfile(path), func() tryLocker { return NewFlockLockfile(path) })
+		},
+	})
+}
@@ -0,0 +1,77 @@
+package lockfile
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrFailedToLock = errors.New("failed to obtain lock")
+	ErrLockTimeout  = errors.New("timed out waiting for lock")
+	ErrNotLocked    = errors.New("file is not locked")
+)
+
+// LockError describes a failed attempt to lock a file. It matches
+// ErrFailedToLock with errors.Is and unwraps to the error of the lock
+// system call.
+type LockError struct {
+	Path string
+	// Mode is "read" or "write".
+	Mode string
+	// Pid is the process holding a conflicting lock, -1 if unknown.
+	Pid int
+	Err error
+}
+
+func (e *LockError) Error() string {
+	if e.Pid > 0 {
+		return fmt.Sprintf("unable to %s lock %s, held by pid %d: %v", e.Mode, e.Path, e.Pid, e.Err)
+	}
+
+	return fmt.Sprintf("unable to %s lock %s: %v", e.Mode, e.Path, e.Err)
+}
+
+func (e *LockError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is ErrFailedToLock.
+func (e *LockError) Is(target error) bool {
+	return target == ErrFailedToLock
+}
+
+// lockMode returns the Mode of a LockError.
+func lockMode(exclusive bool) string {
+	if exclusive {
+		return "write"
+	}
+
+	return "read"
+}
+
+// Locker is the interface that wraps file locking functionality.
+//
+// LockRead locks the file for reading. When a file is locked for
+// reading, other processes may lock the file for reading, but are
+// unable to lock the file for writing. If LockRead cannot obtain
+// the lock it will return an error.
+//
+// LockWrite locks the file for writing. When a file is locked for
+// writing, other processes cannot obtain read or write locks on the
+// file. If LockWrite cannot obtain the lock it will return an error.
+//
+// LockReadB is a blocking version of LockRead. If it cannot obtain
+// the lock it will block until it is able to.
+//
+// LockWriteB is a blocking version of LockWrite. If it cannot obtain
+// the lock it will block until it is able to.
+//
+// Unlock releases the lock on the file. It returns an error if the
+// lock could not be released.
+type Locker interface {
+	LockRead() error
+	LockWrite() error
+	LockReadB() error
+	LockWriteB() error
+	Unlock() error
+}
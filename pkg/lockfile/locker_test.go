@@ -0,0 +1,262 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd || dragonfly || windows
+// +build linux darwin freebsd openbsd netbsd dragonfly windows
+
+package lockfile
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tryLocker is the part of a lock implementation the shared tests use.
+type tryLocker interface {
+	Locker
+	TryLockRead() (bool, error)
+	TryLockWrite() (bool, error)
+}
+
+// lockerCase is a lock under test and another owner of the same lock,
+// like another process.
+type lockerCase struct {
+	lock tryLocker
+	// hold makes the other owner take the lock and returns a function
+	// releasing it.
+	hold func(exclusive bool) func()
+	// probe reports whether the other owner can take the lock.
+	probe func(exclusive bool) bool
+}
+
+// lockerKind is a Locker implementation run through the shared tests.
+type lockerKind struct {
+	name string
+	// open returns a new lock on path.
+	open func(t *testing.T, path string) lockerCase
+}
+
+// lockerKinds are the implementations of the shared tests, flock_test.go
+// adds FlockLockfile on unix.
+var lockerKinds = []lockerKind{
+	{
+		// fcntl locks of the same process never conflict, the other
+		// owner is a helper process
+		name: "Lockfile",
+		open: func(t *testing.T, path string) lockerCase {
+			return lockerCase{
+				lock: NewLockfile(path),
+				hold: func(exclusive bool) func() {
+					return hold(t, "hold-"+lockMode(exclusive), path)
+				},
+				probe: func(exclusive bool) bool {
+					return probe(t, lockMode(exclusive), path)
+				},
+			}
+		},
+	},
+	{
+		name: "MemLockfile",
+		open: func(t *testing.T, path string) lockerCase {
+			l := NewMemLockfile(path)
+
+			return otherHandle(t, l, func() tryLocker { return l.Share() })
+		},
+	},
+}
+
+// otherHandle returns the lockerCase of l whose other owner locks
+// through handles returned by other.
+func otherHandle(t *testing.T, l tryLocker, other func() tryLocker) lockerCase {
+	return lockerCase{
+		lock: l,
+		hold: func(exclusive bool) func() {
+			o := other()
+			mustLock(t, lockFunc(o, exclusive))
+
+			return func() { o.Unlock() }
+		},
+		probe: func(exclusive bool) bool {
+			o := other()
+			defer o.Unlock()
+
+			try := o.TryLockRead
+			if exclusive {
+				try = o.TryLockWrite
+			}
+
+			ok, err := try()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			return ok
+		},
+	}
+}
+
+// lockFunc returns the non-blocking lock function of l for the mode.
+func lockFunc(l Locker, exclusive bool) func() error {
+	if exclusive {
+		return l.LockWrite
+	}
+
+	return l.LockRead
+}
+
+func mustLock(t *testing.T, lock func() error) {
+	t.Helper()
+
+	err := lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockerConflicts(t *testing.T) {
+	tests := []struct {
+		held      bool
+		wantRead  bool
+		wantWrite bool
+	}{
+		{held: false, wantRead: true, wantWrite: false},
+		{held: true, wantRead: false, wantWrite: false},
+	}
+
+	for _, kind := range lockerKinds {
+		for _, tt := range tests {
+			t.Run(kind.name+"/"+lockMode(tt.held), func(t *testing.T) {
+				c := kind.open(t, lockPath(t))
+				c.hold(tt.held)
+
+				ok, err := c.lock.TryLockRead()
+				if err != nil || ok != tt.wantRead {
+					t.Errorf("TryLockRead() = %v, %v, want %v, nil", ok, err, tt.wantRead)
+				}
+
+				c.lock.Unlock()
+
+				ok, err = c.lock.TryLockWrite()
+				if err != nil || ok != tt.wantWrite {
+					t.Errorf("TryLockWrite() = %v, %v, want %v, nil", ok, err, tt.wantWrite)
+				}
+
+				c.lock.Unlock()
+
+				err = c.lock.LockWrite()
+				if !errors.Is(err, ErrFailedToLock) {
+					t.Errorf("LockWrite() = %v, want %v", err, ErrFailedToLock)
+				}
+			})
+		}
+	}
+}
+
+func TestLockerExcludesOthers(t *testing.T) {
+	tests := []struct {
+		exclusive bool
+		wantRead  bool
+	}{
+		{exclusive: false, wantRead: true},
+		{exclusive: true, wantRead: false},
+	}
+
+	for _, kind := range lockerKinds {
+		for _, tt := range tests {
+			t.Run(kind.name+"/"+lockMode(tt.exclusive), func(t *testing.T) {
+				c := kind.open(t, lockPath(t))
+				mustLock(t, lockFunc(c.lock, tt.exclusive))
+
+				if got := c.probe(false); got != tt.wantRead {
+					t.Errorf("other owner can read lock: %v, want %v", got, tt.wantRead)
+				}
+
+				if c.probe(true) {
+					t.Error("other owner can write lock")
+				}
+
+				err := c.lock.Unlock()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !c.probe(true) {
+					t.Error("other owner cannot write lock after Unlock")
+				}
+			})
+		}
+	}
+}
+
+func TestLockerBlockingAfterRelease(t *testing.T) {
+	for _, kind := range lockerKinds {
+		t.Run(kind.name, func(t *testing.T) {
+			c := kind.open(t, lockPath(t))
+			release := c.hold(true)
+
+			done := make(chan error, 1)
+
+			go func() {
+				done <- c.lock.LockWriteB()
+			}()
+
+			select {
+			case err := <-done:
+				t.Fatalf("LockWriteB() = %v while the lock is held", err)
+			case <-time.After(50 * time.Millisecond):
+			}
+
+			release()
+
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatalf("LockWriteB() = %v, want nil", err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("LockWriteB() still blocks after the release")
+			}
+
+			c.lock.Unlock()
+		})
+	}
+}
+
+// TestLockerConcurrent shares one lock between goroutines; the race
+// detector reports unguarded state. Whether locking a held lock again
+// succeeds differs between the implementations, so only the final state
+// is checked.
+func TestLockerConcurrent(t *testing.T) {
+	for _, kind := range lockerKinds {
+		t.Run(kind.name, func(t *testing.T) {
+			c := kind.open(t, lockPath(t))
+
+			var wg sync.WaitGroup
+
+			for range 8 {
+				wg.Add(1)
+
+				go func() {
+					defer wg.Done()
+
+					for range 50 {
+						c.lock.TryLockWrite()
+						c.lock.Unlock()
+						c.lock.TryLockRead()
+						c.lock.Unlock()
+					}
+				}()
+			}
+
+			wg.Wait()
+
+			err := c.lock.Unlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !c.probe(true) {
+				t.Error("other owner cannot write lock after Unlock")
+			}
+		})
+	}
+}
@@ -6,58 +6,73 @@ package lockfile
 
 import (
 	"errors"
-	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
+	"sync"
 	"syscall"
-)
+	"time"
 
-var (
-	ErrFailedToLock = errors.New("failed to obtain lock")
+	"github.com/matbits/counter/pkg/clock"
 )
 
-// Locker is the interface that wraps file locking functionality.
-//
-// LockRead locks the file for reading. When a file is locked for
-// reading, other processes may lock the file for reading, but are
-// unable to lock the file for writing. If LockRead cannot obtain
-// the lock it will return an error.
-//
-// LockWrite locks the file for writing. When a file is locked for
-// writing, other processes cannot obtain read or write locks on the
-// file. If LockWrite cannot obtain the lock it will return an error.
-//
-// LockReadB is a blocking version of LockRead. If it cannot obtain
-// the lock it will block until it is able to.
-//
-// LockWriteB is a blocking version of LockWrite. If it cannot obtain
-// the lock it will block until it is able to.
-//
-// Unlock releases the lock on the file.
-type Locker interface {
-	LockRead() error
-	LockWrite() error
-	LockReadB() error
-	LockWriteB() error
-	Unlock()
-}
+// Lockfile is the file lock implementation of the current platform.
+type Lockfile = FcntlLockfile
 
+// FcntlLockfile is a Locker backed by fcntl(2) record locks. It is safe
+// for concurrent use; a blocking lock call holds the internal mutex until
+// the lock is obtained, so other calls on the same FcntlLockfile wait for
+// it.
 type FcntlLockfile struct {
-	Path         string
+	Path string
+	// RetryInterval is the time to wait between two lock attempts of
+	// LockReadCtx and LockWriteCtx. DefaultRetryInterval is used if zero.
+	RetryInterval time.Duration
+	// Clock is consulted for retry intervals, deadlines and ages.
+	// clock.Real is used if nil.
+	Clock clock.Clock
+	// Logger receives debug messages about lock retries if set.
+	Logger *slog.Logger
+	// mu guards file and ranges.
+	mu           sync.Mutex
 	file         *os.File
 	maintainFile bool
-	ft           *syscall.Flock_t
+	ranges       map[lockRange]int16
+}
+
+// lockRange identifies a byte range lock held on the file.
+type lockRange struct {
+	offset int64
+	whence int
+	len    int64
 }
 
+// NewFcntlLockfile returns a lock for path. The file is opened, and created
+// if needed, by the first lock and closed once no lock is held anymore.
 func NewFcntlLockfile(path string) *FcntlLockfile {
 	return &FcntlLockfile{Path: path, maintainFile: true}
 }
 
+// NewFcntlLockfileFromFile returns a lock on the already open file. The
+// file is never closed by the lock, even if locking fails, so it can be
+// locked and unlocked repeatedly. The caller owns the file and closes it
+// when done; closing any descriptor of the file drops the fcntl locks of
+// the process.
 func NewFcntlLockfileFromFile(file *os.File) *FcntlLockfile {
 	return &FcntlLockfile{file: file, maintainFile: false}
 }
 
+// NewLockfile returns the platform specific lock for path.
+func NewLockfile(path string) *Lockfile {
+	return NewFcntlLockfile(path)
+}
+
+// NewLockfileFromFile returns the platform specific lock on the already
+// open file, see NewFcntlLockfileFromFile.
+func NewLockfileFromFile(file *os.File) *Lockfile {
+	return NewFcntlLockfileFromFile(file)
+}
+
 func (l *FcntlLockfile) LockRead() error {
 	return l.lock(false, false, 0, io.SeekStart, 0)
 }
@@ -74,8 +89,31 @@ func (l *FcntlLockfile) LockWriteB() error {
 	return l.lock(true, true, 0, io.SeekStart, 0)
 }
 
-func (l *FcntlLockfile) Unlock() {
-	l.unlock(0, io.SeekStart, 0)
+// TryLockRead tries to lock the file for reading without blocking. It
+// returns false and no error if the lock is held by another process.
+func (l *FcntlLockfile) TryLockRead() (bool, error) {
+	return l.tryLock(false)
+}
+
+// TryLockWrite tries to lock the file for writing without blocking. It
+// returns false and no error if the lock is held by another process.
+func (l *FcntlLockfile) TryLockWrite() (bool, error) {
+	return l.tryLock(true)
+}
+
+// Unlock releases all locks held on the file, including the ones
+// obtained for byte ranges.
+func (l *FcntlLockfile) Unlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+
+	clear(l.ranges)
+
+	return l.unlock(0, io.SeekStart, 0)
 }
 
 func (l *FcntlLockfile) LockReadRange(offset int64, whence int, len int64) error {
@@ -94,32 +132,197 @@ func (l *FcntlLockfile) LockWriteRangeB(offset int64, whence int, len int64) err
 	return l.lock(true, true, offset, whence, len)
 }
 
-func (l *FcntlLockfile) UnlockRange(offset int64, whence int, len int64) {
-	l.unlock(offset, whence, len)
+// UnlockRange releases the lock of the given byte range. Locks of other
+// ranges stay in place, the file is closed once no range is locked. No
+// shared lock description is modified, so Owner and IsLocked keep
+// querying the whole file afterwards.
+func (l *FcntlLockfile) UnlockRange(offset int64, whence int, len int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+
+	delete(l.ranges, lockRange{offset: offset, whence: whence, len: len})
+
+	return l.unlock(offset, whence, len)
+}
+
+// Upgrade converts the held read locks into write locks on the same
+// descriptor and ranges without blocking. It returns ErrFailedToLock if
+// another process holds a conflicting lock. The upgrade is not atomic:
+// ranges are converted one after another, so with several ranges some
+// may already be upgraded when the error is returned. Ranges which could
+// not be upgraded keep their read lock.
+func (l *FcntlLockfile) Upgrade() error {
+	return l.convert(syscall.F_WRLCK)
+}
+
+// Downgrade converts the held write locks into read locks on the same
+// descriptor and ranges.
+func (l *FcntlLockfile) Downgrade() error {
+	return l.convert(syscall.F_RDLCK)
 }
 
 // Owner will return the pid of the process that owns an fcntl based
 // lock on the file. If the file is not locked it will return -1. If
-// a lock is owned by the current process, it will return -1.
-func (l *FcntlLockfile) Owner() int {
-	ft := &syscall.Flock_t{}
-	*ft = *l.ft
+// a lock is owned by the current process, it will return -1. An error
+// is returned if the lock state cannot be queried. See IsLocked for the
+// caveat of calling it without holding a lock.
+func (l *FcntlLockfile) Owner() (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 
-	err := syscall.FcntlFlock(l.file.Fd(), syscall.F_GETLK, ft)
+	ft, err := l.conflictingLock()
 	if err != nil {
-		fmt.Println(err)
-		return -1
+		return -1, err
 	}
 
 	if ft.Type == syscall.F_UNLCK {
-		fmt.Println(err)
-		return -1
+		return -1, nil
+	}
+
+	return int(ft.Pid), nil
+}
+
+// IsLocked reports whether another process holds a lock on the file
+// that conflicts with a write lock. Locks of the current process are
+// not reported. Locks held by this FcntlLockfile are left untouched, as
+// the query uses its descriptor. Without a lock, a descriptor is opened
+// for the query and closed again, which drops all fcntl locks of the
+// process on the file, including those of other FcntlLockfiles: query
+// through the instance holding the lock instead.
+func (l *FcntlLockfile) IsLocked() (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ft, err := l.conflictingLock()
+	if err != nil {
+		return false, err
+	}
+
+	return ft.Type != syscall.F_UNLCK, nil
+}
+
+// conflictingLock queries the first lock conflicting with a write lock
+// on the whole file with F_GETLK. If no lock conflicts, the returned
+// Type is F_UNLCK. A temporary descriptor is only opened if the file is
+// not open yet; closing it drops the locks of this process held through
+// other descriptors. A file that does not exist is reported as unlocked.
+// The caller must hold mu.
+func (l *FcntlLockfile) conflictingLock() (*syscall.Flock_t, error) {
+	ft := &syscall.Flock_t{Type: syscall.F_WRLCK, Whence: io.SeekStart}
+
+	file := l.file
+	if file == nil {
+		f, err := os.Open(l.Path)
+		if errors.Is(err, os.ErrNotExist) {
+			ft.Type = syscall.F_UNLCK
+
+			return ft, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer f.Close()
+
+		file = f
+	}
+
+	err := syscall.FcntlFlock(file.Fd(), syscall.F_GETLK, ft)
+	if err != nil {
+		return nil, err
+	}
+
+	return ft, nil
+}
+
+func (l *FcntlLockfile) convert(typ int16) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.locked() {
+		return ErrNotLocked
+	}
+
+	for r := range l.ranges {
+		ft := &syscall.Flock_t{
+			Type:   typ,
+			Whence: int16(r.whence),
+			Start:  r.offset,
+			Len:    r.len,
+			Pid:    int32(os.Getpid()),
+		}
+
+		err := syscall.FcntlFlock(l.file.Fd(), syscall.F_SETLK, ft)
+		if errno, ok := err.(syscall.Errno); ok {
+			return l.lockError(typ == syscall.F_WRLCK, errno)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		l.ranges[r] = typ
+	}
+
+	return nil
+}
+
+func (l *FcntlLockfile) tryLock(exclusive bool) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := l.setLock(exclusive, false, 0, io.SeekStart, 0)
+	if errno, ok := err.(syscall.Errno); ok && (errno == syscall.EAGAIN || errno == syscall.EACCES) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
 	}
 
-	return int(ft.Pid)
+	return true, nil
 }
 
 func (l *FcntlLockfile) lock(exclusive, blocking bool, offset int64, whence int, len int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := l.setLock(exclusive, blocking, offset, whence, len)
+	if errno, ok := err.(syscall.Errno); ok {
+		return l.lockError(exclusive, errno)
+	}
+
+	return err
+}
+
+// lockError returns a LockError for the failed fcntl call. The pid of
+// the conflicting lock is looked up if the lock is held elsewhere. The
+// caller must hold mu.
+func (l *FcntlLockfile) lockError(exclusive bool, errno syscall.Errno) *LockError {
+	e := &LockError{Path: l.Path, Mode: lockMode(exclusive), Pid: -1, Err: errno}
+	if e.Path == "" && l.file != nil {
+		e.Path = l.file.Name()
+	}
+
+	if errno == syscall.EAGAIN || errno == syscall.EACCES {
+		ft, err := l.conflictingLock()
+		if err == nil && ft.Type != syscall.F_UNLCK {
+			e.Pid = int(ft.Pid)
+		}
+	}
+
+	return e
+}
+
+// setLock opens the file if required and applies the lock. Errors of
+// the fcntl call are returned as plain syscall.Errno. The caller must
+// hold mu.
+func (l *FcntlLockfile) setLock(exclusive, blocking bool, offset int64, whence int, len int64) error {
 	if l.file == nil {
 		f, err := os.OpenFile(l.Path, os.O_CREATE|os.O_RDWR, 0666)
 		if err != nil {
@@ -134,7 +337,6 @@ func (l *FcntlLockfile) lock(exclusive, blocking bool, offset int64, whence int,
 		Len:    len,
 		Pid:    int32(os.Getpid()),
 	}
-	l.ft = ft
 
 	if exclusive {
 		ft.Type = syscall.F_WRLCK
@@ -148,29 +350,52 @@ func (l *FcntlLockfile) lock(exclusive, blocking bool, offset int64, whence int,
 		flags = syscall.F_SETLK
 	}
 
-	err := syscall.FcntlFlock(l.file.Fd(), flags, l.ft)
+	err := syscall.FcntlFlock(l.file.Fd(), flags, ft)
+	// F_SETLKW is interrupted by signals handled by the process
+	for blocking && err == syscall.EINTR {
+		err = syscall.FcntlFlock(l.file.Fd(), flags, ft)
+	}
 	if err != nil {
-		if l.maintainFile {
+		// closing the file would release the locks of other ranges
+		if l.maintainFile && !l.locked() {
 			l.file.Close()
+			l.file = nil
 		}
-		return ErrFailedToLock
+		return err
 	}
 
+	if l.ranges == nil {
+		l.ranges = make(map[lockRange]int16)
+	}
+	l.ranges[lockRange{offset: offset, whence: whence, len: len}] = ft.Type
+
 	return nil
 }
 
-func (l *FcntlLockfile) unlock(offset int64, whence int, len int64) {
-	l.ft.Len = len
-	l.ft.Start = offset
-	l.ft.Whence = int16(whence)
-	l.ft.Type = syscall.F_UNLCK
+// locked reports whether any range of the file is locked. The caller
+// must hold mu.
+func (l *FcntlLockfile) locked() bool {
+	return len(l.ranges) > 0
+}
 
-	err := syscall.FcntlFlock(l.file.Fd(), syscall.F_SETLK, l.ft)
-	if err != nil {
-		log.Printf("err unlock: %s", err)
+func (l *FcntlLockfile) unlock(offset int64, whence int, len int64) error {
+	ft := &syscall.Flock_t{
+		Type:   syscall.F_UNLCK,
+		Whence: int16(whence),
+		Start:  offset,
+		Len:    len,
 	}
 
-	if l.maintainFile {
-		l.file.Close()
+	err := syscall.FcntlFlock(l.file.Fd(), syscall.F_SETLK, ft)
+
+	if l.maintainFile && !l.locked() {
+		cerr := l.file.Close()
+		l.file = nil
+
+		if err == nil {
+			err = cerr
+		}
 	}
+
+	return err
 }
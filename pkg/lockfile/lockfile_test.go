@@ -0,0 +1,387 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd || dragonfly || windows
+// +build linux darwin freebsd openbsd netbsd dragonfly windows
+
+package lockfile
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matbits/counter/pkg/clock"
+)
+
+// helperEnv makes the test binary act as another process locking a file,
+// as locks of the own process never conflict with fcntl(2).
+const helperEnv = "LOCKFILE_TEST_HELPER"
+
+func TestMain(m *testing.M) {
+	if args := os.Getenv(helperEnv); args != "" {
+		os.Exit(runHelper(strings.Fields(args)))
+	}
+
+	os.Exit(m.Run())
+}
+
+// runHelper runs the helper command args against the file args[1]:
+//
+//	hold-read, hold-write     lock the whole file, print "locked" and
+//	                          hold the lock until stdin is closed
+//	hold-range offset len     write lock a range like hold-write
+//	probe-read, probe-write   print whether the lock can be taken
+//	probe-range offset len    print whether a range can be write locked
+func runHelper(args []string) int {
+	l := NewLockfile(args[1])
+
+	var err error
+
+	switch args[0] {
+	case "hold-read":
+		err = l.LockRead()
+	case "hold-write":
+		err = l.LockWrite()
+	case "hold-range":
+		offset, _ := strconv.ParseInt(args[2], 10, 64)
+		n, _ := strconv.ParseInt(args[3], 10, 64)
+		err = l.LockWriteRange(offset, io.SeekStart, n)
+	case "probe-range":
+		offset, _ := strconv.ParseInt(args[2], 10, 64)
+		n, _ := strconv.ParseInt(args[3], 10, 64)
+
+		err = l.LockWriteRange(offset, io.SeekStart, n)
+		if err == nil || errors.Is(err, ErrFailedToLock) {
+			fmt.Println(err == nil)
+
+			return 0
+		}
+	case "probe-read", "probe-write":
+		var ok bool
+
+		ok, err = l.tryLock(args[0] == "probe-write")
+		if err == nil {
+			fmt.Println(ok)
+
+			return 0
+		}
+	default:
+		err = errors.New("unknown helper command")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+
+		return 1
+	}
+
+	fmt.Println("locked")
+	io.Copy(io.Discard, os.Stdin)
+
+	return 0
+}
+
+// helper starts a helper process with args and returns its stdout, the
+// process and a function closing its stdin, which ends a holding helper,
+// and waiting for it to exit. The function may be called several times
+// and from any goroutine.
+func helper(t *testing.T, args ...string) (*bufio.Reader, *exec.Cmd, func()) {
+	t.Helper()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), helperEnv+"="+strings.Join(args, " "))
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := sync.OnceFunc(func() {
+		stdin.Close()
+		cmd.Wait()
+	})
+
+	t.Cleanup(stop)
+
+	return bufio.NewReader(stdout), cmd, stop
+}
+
+// hold makes a helper process take a lock and returns a function
+// releasing it.
+func hold(t *testing.T, args ...string) func() {
+	t.Helper()
+
+	release, _ := holdPid(t, args...)
+
+	return release
+}
+
+// holdPid is hold, also returning the pid of the helper process.
+func holdPid(t *testing.T, args ...string) (func(), int) {
+	t.Helper()
+
+	out, cmd, stop := helper(t, args...)
+
+	line, err := out.ReadString('\n')
+	if strings.TrimSpace(line) != "locked" {
+		t.Fatalf("helper %v did not lock: %q, %v", args, line, err)
+	}
+
+	return stop, cmd.Process.Pid
+}
+
+// probe reports whether another process can take the lock of path. The
+// mode "range" is followed by the offset and length of the range.
+func probe(t *testing.T, mode, path string, args ...string) bool {
+	t.Helper()
+
+	out, _, stop := helper(t, append([]string{"probe-" + mode, path}, args...)...)
+
+	line, err := out.ReadString('\n')
+	if err != nil {
+		t.Fatalf("probe-%s: %v", mode, err)
+	}
+
+	// a successful probe holds the lock until it exits
+	stop()
+
+	return strings.TrimSpace(line) == "true"
+}
+
+func lockPath(t *testing.T) string {
+	return filepath.Join(t.TempDir(), "test.lock")
+}
+
+func TestLockRangeConflicts(t *testing.T) {
+	path := lockPath(t)
+	hold(t, "hold-range", path, "0", "10")
+
+	tests := []struct {
+		offset, len int64
+		wantErr     bool
+	}{
+		{offset: 10, len: 10},
+		{offset: 5, len: 10, wantErr: true},
+		{offset: 0, len: 1, wantErr: true},
+		{offset: 100, len: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d+%d", tt.offset, tt.len), func(t *testing.T) {
+			l := NewLockfile(path)
+
+			err := l.LockWriteRange(tt.offset, io.SeekStart, tt.len)
+			if tt.wantErr != errors.Is(err, ErrFailedToLock) {
+				t.Errorf("LockWriteRange(%d, %d) = %v, want error %v", tt.offset, tt.len, err, tt.wantErr)
+			}
+
+			err = l.UnlockRange(tt.offset, io.SeekStart, tt.len)
+			if err != nil {
+				t.Errorf("UnlockRange: %v", err)
+			}
+		})
+	}
+}
+
+func TestLockWriteTimeout(t *testing.T) {
+	path := lockPath(t)
+	hold(t, "hold-write", path)
+
+	clk := clock.NewFake(time.Now())
+
+	l := NewLockfile(path)
+	l.RetryInterval = time.Second
+	l.Clock = clk
+
+	done := make(chan error, 1)
+
+	go func() {
+		done <- l.LockWriteTimeout(time.Minute)
+	}()
+
+	// the deadline and the first retry
+	clk.BlockUntil(2)
+	clk.Advance(time.Minute - time.Second)
+
+	select {
+	case err := <-done:
+		t.Fatalf("LockWriteTimeout() = %v before the deadline", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	clk.Advance(time.Second)
+
+	err := <-done
+	if !errors.Is(err, ErrLockTimeout) {
+		t.Errorf("LockWriteTimeout() = %v, want %v", err, ErrLockTimeout)
+	}
+}
+
+func TestLockWriteCtxAfterRelease(t *testing.T) {
+	path := lockPath(t)
+	release := hold(t, "hold-write", path)
+
+	released := make(chan struct{})
+	time.AfterFunc(100*time.Millisecond, func() {
+		release()
+		close(released)
+	})
+	defer func() { <-released }()
+
+	l := NewLockfile(path)
+	l.RetryInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := l.LockWriteCtx(ctx)
+	if err != nil {
+		t.Fatalf("LockWriteCtx() = %v, want nil", err)
+	}
+
+	l.Unlock()
+}
+
+func TestUpgradeDowngrade(t *testing.T) {
+	path := lockPath(t)
+	l := NewLockfile(path)
+
+	err := l.Upgrade()
+	if !errors.Is(err, ErrNotLocked) {
+		t.Fatalf("Upgrade() without lock = %v, want %v", err, ErrNotLocked)
+	}
+
+	err = l.LockRead()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Unlock()
+
+	steps := []struct {
+		name      string
+		do        func() error
+		wantRead  bool
+		wantWrite bool
+	}{
+		{name: "read", do: func() error { return nil }, wantRead: true},
+		{name: "upgrade", do: l.Upgrade},
+		{name: "downgrade", do: l.Downgrade, wantRead: true},
+		{name: "unlock", do: l.Unlock, wantRead: true, wantWrite: true},
+	}
+
+	for _, step := range steps {
+		err := step.do()
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+
+		if got := probe(t, "read", path); got != step.wantRead {
+			t.Errorf("after %s another process can read lock: %v, want %v", step.name, got, step.wantRead)
+		}
+
+		if got := probe(t, "write", path); got != step.wantWrite {
+			t.Errorf("after %s another process can write lock: %v, want %v", step.name, got, step.wantWrite)
+		}
+	}
+}
+
+func TestUnlockRangeKeepsOtherRanges(t *testing.T) {
+	path := lockPath(t)
+	l := NewLockfile(path)
+
+	for _, offset := range []int64{0, 20} {
+		err := l.LockWriteRange(offset, io.SeekStart, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer l.Unlock()
+
+	err := l.UnlockRange(0, io.SeekStart, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		offset string
+		want   bool
+	}{
+		{offset: "0", want: true},
+		{offset: "10", want: true},
+		{offset: "20", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := probe(t, "range", path, tt.offset, "10"); got != tt.want {
+			t.Errorf("another process can lock [%s, +10): %v, want %v", tt.offset, got, tt.want)
+		}
+	}
+
+	err = l.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !probe(t, "range", path, "20", "10") {
+		t.Error("Unlock kept the lock of [20, +10)")
+	}
+}
+
+func TestFromFileRelock(t *testing.T) {
+	path := lockPath(t)
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	l := NewLockfileFromFile(f)
+
+	for i := range 3 {
+		err = l.LockWrite()
+		if err != nil {
+			t.Fatalf("LockWrite() #%d: %v", i, err)
+		}
+
+		if probe(t, "read", path) {
+			t.Fatalf("LockWrite() #%d: another process can read lock", i)
+		}
+
+		err = l.Unlock()
+		if err != nil {
+			t.Fatalf("Unlock() #%d: %v", i, err)
+		}
+
+		if !probe(t, "write", path) {
+			t.Fatalf("Unlock() #%d: another process cannot write lock", i)
+		}
+	}
+
+	// the file is still open and owned by the caller
+	_, err = f.Write([]byte("x"))
+	if err != nil {
+		t.Errorf("file unusable after Unlock: %v", err)
+	}
+}
@@ -0,0 +1,471 @@
+//go:build windows
+// +build windows
+
+package lockfile
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/matbits/counter/pkg/clock"
+)
+
+const (
+	lockfileFailImmediately = 0x00000001
+	lockfileExclusiveLock   = 0x00000002
+
+	errorLockViolation syscall.Errno = 33
+)
+
+var (
+	modkernel32      = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = modkernel32.NewProc("LockFileEx")
+	procUnlockFileEx = modkernel32.NewProc("UnlockFileEx")
+)
+
+// Lockfile is a Locker backed by LockFileEx and UnlockFileEx. It has the
+// method set of FcntlLockfile, so code using it builds on every platform.
+// It is safe for concurrent use; a blocking lock call holds the internal
+// mutex until the lock is obtained, so other calls on the same Lockfile
+// wait for it.
+type Lockfile struct {
+	Path string
+	// RetryInterval is the time to wait between two lock attempts of
+	// LockReadCtx and LockWriteCtx. DefaultRetryInterval is used if zero.
+	RetryInterval time.Duration
+	// Clock is consulted for retry intervals and deadlines. clock.Real is
+	// used if nil.
+	Clock clock.Clock
+	// Logger receives debug messages about lock retries if set.
+	Logger *slog.Logger
+	// mu guards file and ranges.
+	mu           sync.Mutex
+	file         *os.File
+	maintainFile bool
+	ranges       map[lockRange]region
+}
+
+// lockRange identifies a byte range lock as requested by the caller.
+type lockRange struct {
+	offset int64
+	whence int
+	len    int64
+}
+
+// region is the absolute byte range locked for a lockRange.
+type region struct {
+	start     uint64
+	len       uint64
+	exclusive bool
+}
+
+// NewLockfile returns a lock for path. The file is opened, and created if
+// needed, by the first lock and closed once no lock is held anymore.
+func NewLockfile(path string) *Lockfile {
+	return &Lockfile{Path: path, maintainFile: true}
+}
+
+// NewLockfileFromFile returns a lock on the already open file. The file
+// is never closed by the lock, so it can be locked and unlocked
+// repeatedly. The caller owns the file and closes it when done.
+func NewLockfileFromFile(file *os.File) *Lockfile {
+	return &Lockfile{file: file, maintainFile: false}
+}
+
+func (l *Lockfile) LockRead() error {
+	return l.lock(false, false, 0, io.SeekStart, 0)
+}
+
+func (l *Lockfile) LockWrite() error {
+	return l.lock(true, false, 0, io.SeekStart, 0)
+}
+
+func (l *Lockfile) LockReadB() error {
+	return l.lock(false, true, 0, io.SeekStart, 0)
+}
+
+func (l *Lockfile) LockWriteB() error {
+	return l.lock(true, true, 0, io.SeekStart, 0)
+}
+
+// TryLockRead tries to lock the file for reading without blocking. It
+// returns false and no error if the lock is held by another process.
+func (l *Lockfile) TryLockRead() (bool, error) {
+	return l.tryLock(false)
+}
+
+// TryLockWrite tries to lock the file for writing without blocking. It
+// returns false and no error if the lock is held by another process.
+func (l *Lockfile) TryLockWrite() (bool, error) {
+	return l.tryLock(true)
+}
+
+// Unlock releases all locks held on the file, including the ones
+// obtained for byte ranges.
+func (l *Lockfile) Unlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+
+	var err error
+
+	for key, r := range l.ranges {
+		uerr := unlockFileEx(l.file, r.start, r.len)
+		if err == nil {
+			err = uerr
+		}
+
+		delete(l.ranges, key)
+	}
+
+	cerr := l.closeUnused()
+	if err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// LockReadRange locks a byte range for reading. whence is interpreted as
+// by io.Seeker, relative to the current size or position of the file
+// when the lock is taken. A zero len locks up to the largest offset.
+func (l *Lockfile) LockReadRange(offset int64, whence int, len int64) error {
+	return l.lock(false, false, offset, whence, len)
+}
+
+func (l *Lockfile) LockWriteRange(offset int64, whence int, len int64) error {
+	return l.lock(true, false, offset, whence, len)
+}
+
+func (l *Lockfile) LockReadRangeB(offset int64, whence int, len int64) error {
+	return l.lock(false, true, offset, whence, len)
+}
+
+func (l *Lockfile) LockWriteRangeB(offset int64, whence int, len int64) error {
+	return l.lock(true, true, offset, whence, len)
+}
+
+// UnlockRange releases the lock of the given byte range, which must be
+// passed as it was locked. Locks of other ranges stay in place, the file
+// is closed once no range is locked.
+func (l *Lockfile) UnlockRange(offset int64, whence int, len int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+
+	key := lockRange{offset: offset, whence: whence, len: len}
+
+	r, ok := l.ranges[key]
+	if !ok {
+		return nil
+	}
+
+	err := unlockFileEx(l.file, r.start, r.len)
+	delete(l.ranges, key)
+
+	cerr := l.closeUnused()
+	if err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// Upgrade converts the held read locks into write locks without
+// blocking. It returns ErrFailedToLock if another process holds a
+// conflicting lock. Windows cannot convert a lock, so every read lock is
+// released before the write lock is tried and taken back if that fails;
+// another process may take the range in between, in which case the
+// range is no longer locked afterwards.
+func (l *Lockfile) Upgrade() error {
+	return l.convert(true)
+}
+
+// Downgrade converts the held write locks into read locks. As a read
+// lock may overlap a write lock of the same handle, the read lock is
+// taken before the write lock is released, so the range stays locked.
+func (l *Lockfile) Downgrade() error {
+	return l.convert(false)
+}
+
+// Owner always returns -1, Windows does not report the process holding
+// a lock.
+func (l *Lockfile) Owner() (int, error) {
+	return -1, nil
+}
+
+// IsLocked reports whether the file is locked. Windows has no way to
+// query a lock, so it probes with an exclusive lock on a separate handle,
+// which is released again at once. Unlike on Unix, locks held by the
+// current process through other handles are reported as well.
+func (l *Lockfile) IsLocked() (bool, error) {
+	f, err := os.Open(l.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	defer f.Close()
+
+	err = lockFileEx(f, lockfileExclusiveLock|lockfileFailImmediately, 0, ^uint64(0))
+	if err == errorLockViolation {
+		return true, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	unlockFileEx(f, 0, ^uint64(0))
+
+	return false, nil
+}
+
+func (l *Lockfile) convert(exclusive bool) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.ranges) == 0 {
+		return ErrNotLocked
+	}
+
+	for key, r := range l.ranges {
+		if r.exclusive == exclusive {
+			continue
+		}
+
+		err := l.convertRange(key, r, exclusive)
+		if errno, ok := err.(syscall.Errno); ok {
+			return l.lockError(exclusive, errno)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// convertRange converts the lock of key to exclusive without blocking.
+// The caller must hold mu.
+func (l *Lockfile) convertRange(key lockRange, r region, exclusive bool) error {
+	if !exclusive {
+		err := lockFileEx(l.file, lockfileFailImmediately, r.start, r.len)
+		if err != nil {
+			return err
+		}
+
+		// releases the write lock, which was taken first
+		err = unlockFileEx(l.file, r.start, r.len)
+		if err != nil {
+			return err
+		}
+
+		l.ranges[key] = region{start: r.start, len: r.len}
+
+		return nil
+	}
+
+	err := unlockFileEx(l.file, r.start, r.len)
+	if err != nil {
+		return err
+	}
+
+	err = lockFileEx(l.file, lockfileExclusiveLock|lockfileFailImmediately, r.start, r.len)
+	if err == nil {
+		l.ranges[key] = region{start: r.start, len: r.len, exclusive: true}
+
+		return nil
+	}
+
+	if lockFileEx(l.file, lockfileFailImmediately, r.start, r.len) != nil {
+		delete(l.ranges, key)
+	}
+
+	return err
+}
+
+func (l *Lockfile) tryLock(exclusive bool) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := l.setLock(exclusive, false, 0, io.SeekStart, 0)
+	if err == errorLockViolation {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (l *Lockfile) lock(exclusive, blocking bool, offset int64, whence int, len int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := l.setLock(exclusive, blocking, offset, whence, len)
+	if errno, ok := err.(syscall.Errno); ok {
+		return l.lockError(exclusive, errno)
+	}
+
+	return err
+}
+
+// lockError returns a LockError for the failed LockFileEx call. The
+// caller must hold mu.
+func (l *Lockfile) lockError(exclusive bool, errno syscall.Errno) *LockError {
+	e := &LockError{Path: l.Path, Mode: lockMode(exclusive), Pid: -1, Err: errno}
+	if e.Path == "" && l.file != nil {
+		e.Path = l.file.Name()
+	}
+
+	return e
+}
+
+// setLock opens the file if required and applies the lock. Locking a
+// range again in the other mode converts its lock. Errors of the
+// LockFileEx call are returned as plain syscall.Errno. The caller must
+// hold mu.
+func (l *Lockfile) setLock(exclusive, blocking bool, offset int64, whence int, len int64) error {
+	if l.file == nil {
+		f, err := os.OpenFile(l.Path, os.O_CREATE|os.O_RDWR, 0666)
+		if err != nil {
+			return err
+		}
+		l.file = f
+	}
+
+	key := lockRange{offset: offset, whence: whence, len: len}
+
+	if r, ok := l.ranges[key]; ok {
+		if r.exclusive == exclusive {
+			return nil
+		}
+
+		return l.convertRange(key, r, exclusive)
+	}
+
+	start, n, err := l.region(offset, whence, len)
+	if err != nil {
+		l.closeUnused()
+
+		return err
+	}
+
+	var flags uintptr
+	if exclusive {
+		flags |= lockfileExclusiveLock
+	}
+	if !blocking {
+		flags |= lockfileFailImmediately
+	}
+
+	err = lockFileEx(l.file, flags, start, n)
+	if err != nil {
+		l.closeUnused()
+
+		return err
+	}
+
+	if l.ranges == nil {
+		l.ranges = make(map[lockRange]region)
+	}
+	l.ranges[key] = region{start: start, len: n, exclusive: exclusive}
+
+	return nil
+}
+
+// region returns the absolute start and length of a range as fcntl(2)
+// would lock it. The caller must hold mu.
+func (l *Lockfile) region(offset int64, whence int, len int64) (uint64, uint64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		pos, err := l.file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		offset += pos
+	case io.SeekEnd:
+		fi, err := l.file.Stat()
+		if err != nil {
+			return 0, 0, err
+		}
+
+		offset += fi.Size()
+	default:
+		return 0, 0, syscall.EINVAL
+	}
+
+	if len < 0 {
+		offset, len = offset+len, -len
+	}
+
+	if offset < 0 {
+		return 0, 0, syscall.EINVAL
+	}
+
+	if len == 0 {
+		return uint64(offset), ^uint64(0) - uint64(offset), nil
+	}
+
+	return uint64(offset), uint64(len), nil
+}
+
+// closeUnused closes a file opened by the lock once no range is locked.
+// The caller must hold mu.
+func (l *Lockfile) closeUnused() error {
+	if !l.maintainFile || len(l.ranges) > 0 {
+		return nil
+	}
+
+	err := l.file.Close()
+	l.file = nil
+
+	return err
+}
+
+// lockFileEx locks n bytes of f at start. Errors are returned as plain
+// syscall.Errno.
+func lockFileEx(f *os.File, flags uintptr, start, n uint64) error {
+	ol := &syscall.Overlapped{Offset: uint32(start), OffsetHigh: uint32(start >> 32)}
+
+	r1, _, err := procLockFileEx.Call(f.Fd(), flags, 0, uintptr(uint32(n)), uintptr(uint32(n>>32)), uintptr(unsafe.Pointer(ol)))
+	if r1 == 0 {
+		return err
+	}
+
+	return nil
+}
+
+// unlockFileEx unlocks n bytes of f at start. Errors are returned as
+// plain syscall.Errno.
+func unlockFileEx(f *os.File, start, n uint64) error {
+	ol := &syscall.Overlapped{Offset: uint32(start), OffsetHigh: uint32(start >> 32)}
+
+	r1, _, err := procUnlockFileEx.Call(f.Fd(), 0, uintptr(uint32(n)), uintptr(uint32(n>>32)), uintptr(unsafe.Pointer(ol)))
+	if r1 == 0 {
+		return err
+	}
+
+	return nil
+}
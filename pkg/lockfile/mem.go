@@ -0,0 +1,137 @@
+package lockfile
+
+import (
+	"errors"
+	"sync"
+)
+
+// errHeld is the error of a LockError of a MemLockfile that is locked
+// already.
+var errHeld = errors.New("lock is already held by this handle")
+
+// MemLockfile is a Locker backed by a sync.RWMutex instead of a file, so
+// code using a Locker can be tested without the file system. Handles
+// returned by Share lock the same mutex, like separate processes locking
+// the same file. A handle holds at most one lock at a time; locking it
+// again before Unlock fails. It is safe for concurrent use.
+type MemLockfile struct {
+	// Name is used as Path of the LockError of a failed lock.
+	Name string
+
+	rw *sync.RWMutex
+	// mu guards held.
+	mu   sync.Mutex
+	held int
+}
+
+const (
+	memUnlocked = iota
+	memRead
+	memWrite
+)
+
+// NewMemLockfile returns an unlocked in-memory lock named name.
+func NewMemLockfile(name string) *MemLockfile {
+	return &MemLockfile{Name: name, rw: new(sync.RWMutex)}
+}
+
+// Share returns a new, unlocked handle on the same in-memory lock.
+func (l *MemLockfile) Share() *MemLockfile {
+	return &MemLockfile{Name: l.Name, rw: l.rw}
+}
+
+func (l *MemLockfile) LockRead() error {
+	return l.lock(false, false)
+}
+
+func (l *MemLockfile) LockWrite() error {
+	return l.lock(true, false)
+}
+
+func (l *MemLockfile) LockReadB() error {
+	return l.lock(false, true)
+}
+
+func (l *MemLockfile) LockWriteB() error {
+	return l.lock(true, true)
+}
+
+// TryLockRead tries to lock for reading without blocking. It returns
+// false and no error if the lock is held for writing by another handle.
+func (l *MemLockfile) TryLockRead() (bool, error) {
+	return l.tryLock(false)
+}
+
+// TryLockWrite tries to lock for writing without blocking. It returns
+// false and no error if the lock is held by another handle.
+func (l *MemLockfile) TryLockWrite() (bool, error) {
+	return l.tryLock(true)
+}
+
+// Unlock releases the lock held by the handle. It does nothing if the
+// handle holds no lock.
+func (l *MemLockfile) Unlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	switch l.held {
+	case memRead:
+		l.rw.RUnlock()
+	case memWrite:
+		l.rw.Unlock()
+	}
+
+	l.held = memUnlocked
+
+	return nil
+}
+
+func (l *MemLockfile) tryLock(exclusive bool) (bool, error) {
+	err := l.lock(exclusive, false)
+	if errors.Is(err, errHeld) {
+		return false, err
+	}
+
+	if err != nil {
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// lock obtains the lock. mu is held while blocking, so Unlock of the same
+// handle waits for a blocking lock to return, like the file locks.
+func (l *MemLockfile) lock(exclusive, blocking bool) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.held != memUnlocked {
+		return &LockError{Path: l.Name, Mode: lockMode(exclusive), Pid: -1, Err: errHeld}
+	}
+
+	var ok bool
+
+	switch {
+	case exclusive && blocking:
+		l.rw.Lock()
+		ok = true
+	case exclusive:
+		ok = l.rw.TryLock()
+	case blocking:
+		l.rw.RLock()
+		ok = true
+	default:
+		ok = l.rw.TryRLock()
+	}
+
+	if !ok {
+		return &LockError{Path: l.Name, Mode: lockMode(exclusive), Pid: -1, Err: ErrFailedToLock}
+	}
+
+	l.held = memRead
+	if exclusive {
+		l.held = memWrite
+	}
+
+	return nil
+}
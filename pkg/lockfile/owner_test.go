@@ -0,0 +1,108 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd || dragonfly
+// +build linux darwin freebsd openbsd netbsd dragonfly
+
+package lockfile
+
+import (
+	"io"
+	"testing"
+)
+
+func TestOwner(t *testing.T) {
+	tests := []struct {
+		name       string
+		other      string
+		own        string
+		wantLocked bool
+		wantOwner  bool
+	}{
+		{name: "unlocked"},
+		{name: "write locked by another process", other: "hold-write", wantLocked: true, wantOwner: true},
+		{name: "read locked by another process", other: "hold-read", wantLocked: true, wantOwner: true},
+		{name: "locked by this instance", own: "write"},
+		{name: "read locked by both", other: "hold-read", own: "read", wantLocked: true, wantOwner: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := lockPath(t)
+
+			var pid int
+
+			if tt.other != "" {
+				_, pid = holdPid(t, tt.other, path)
+			}
+
+			l := NewFcntlLockfile(path)
+
+			switch tt.own {
+			case "read":
+				mustLock(t, l.LockRead)
+			case "write":
+				mustLock(t, l.LockWrite)
+			}
+
+			defer l.Unlock()
+
+			locked, err := l.IsLocked()
+			if err != nil || locked != tt.wantLocked {
+				t.Errorf("IsLocked() = %v, %v, want %v, nil", locked, err, tt.wantLocked)
+			}
+
+			owner, err := l.Owner()
+			if err != nil || (owner == pid) != tt.wantOwner || (!tt.wantOwner && owner != -1) {
+				t.Errorf("Owner() = %d, %v, want the pid of the helper: %v", owner, err, tt.wantOwner)
+			}
+
+			// the queries use the descriptor of the held lock, closing
+			// another one would have dropped it
+			if tt.own == "write" && probe(t, "read", path) {
+				t.Error("the write lock was dropped by the queries")
+			}
+
+			if tt.own == "read" && probe(t, "write", path) {
+				t.Error("the read lock was dropped by the queries")
+			}
+		})
+	}
+}
+
+func TestOwnerAfterUnlockRange(t *testing.T) {
+	tests := []struct {
+		name  string
+		other bool
+	}{
+		{name: "unlocked elsewhere"},
+		{name: "range locked by another process", other: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := lockPath(t)
+
+			pid := -1
+			if tt.other {
+				_, pid = holdPid(t, "hold-range", path, "0", "10")
+			}
+
+			l := NewFcntlLockfile(path)
+
+			err := l.LockWriteRange(20, io.SeekStart, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = l.UnlockRange(20, io.SeekStart, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for name, lock := range map[string]*FcntlLockfile{"unlocked": l, "fresh": NewFcntlLockfile(path)} {
+				owner, err := lock.Owner()
+				if err != nil || owner != pid {
+					t.Errorf("Owner() of the %s lock = %d, %v, want %d, nil", name, owner, err, pid)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd || dragonfly
+// +build linux darwin freebsd openbsd netbsd dragonfly
+
+package lockfile
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestLockWriteBSignal(t *testing.T) {
+	tests := []struct {
+		name string
+		// hold locks path elsewhere and returns a function releasing it.
+		hold func(t *testing.T, path string) func()
+		lock func(path string) Locker
+	}{
+		{
+			name: "fcntl",
+			hold: func(t *testing.T, path string) func() {
+				return hold(t, "hold-write", path)
+			},
+			lock: func(path string) Locker { return NewFcntlLockfile(path) },
+		},
+		{
+			// flock locks of separate opens conflict within the process
+			name: "flock",
+			hold: func(t *testing.T, path string) func() {
+				l := NewFlockLockfile(path)
+				mustLock(t, l.LockWrite)
+
+				return func() { l.Unlock() }
+			},
+			lock: func(path string) Locker { return NewFlockLockfile(path) },
+		},
+	}
+
+	// a handled signal interrupts blocking system calls
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	defer signal.Stop(c)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := lockPath(t)
+			release := tt.hold(t, path)
+
+			l := tt.lock(path)
+			done := make(chan error, 1)
+
+			go func() {
+				done <- l.LockWriteB()
+			}()
+
+			for range 5 {
+				time.Sleep(20 * time.Millisecond)
+				syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+
+				select {
+				case err := <-done:
+					t.Fatalf("LockWriteB() returned %v while the lock is held", err)
+				case <-c:
+				}
+			}
+
+			release()
+
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatalf("LockWriteB() = %v, want nil", err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("LockWriteB() did not return after the lock was released")
+			}
+
+			l.Unlock()
+		})
+	}
+}
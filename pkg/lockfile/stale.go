@@ -0,0 +1,139 @@
+//go:build (linux || darwin || freebsd || openbsd || netbsd || dragonfly) && go1.3
+// +build linux darwin freebsd openbsd netbsd dragonfly
+// +build go1.3
+
+package lockfile
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/matbits/counter/pkg/clock"
+)
+
+// BreakStaleLock removes the lock file if it is older than maxAge and its
+// owner is not alive. This is meant for deployments which treat the
+// presence of the lock file as lock, as fcntl locks of a killed process
+// are released by the kernel anyway. The owner is the process holding an
+// fcntl lock on the file, see Owner, or else the pid the file holds as
+// decimal number under that convention. A file without a pid is only
+// judged by its age. The file is write locked while it is checked again
+// and removed, so no other process can lock it in between. A lock held by this FcntlLockfile is never broken, but
+// fcntl locks of the same process do not conflict: a lock held by
+// another FcntlLockfile of this process is broken, and the locks of the
+// process on the file are dropped when it is unlocked. It reports
+// whether the file was removed.
+func (l *FcntlLockfile) BreakStaleLock(maxAge time.Duration) (bool, error) {
+	l.mu.Lock()
+	locked := l.locked()
+	l.mu.Unlock()
+
+	if locked {
+		return false, nil
+	}
+
+	// a missing file must not be created by the lock below
+	_, stale, err := l.stale(maxAge)
+	if err != nil || !stale {
+		return false, err
+	}
+
+	pid, err := l.Owner()
+	if err != nil {
+		return false, err
+	}
+
+	if pid > 0 && processAlive(pid) {
+		return false, nil
+	}
+
+	ok, err := l.TryLockWrite()
+	if err != nil || !ok {
+		return false, err
+	}
+
+	defer l.Unlock()
+
+	l.mu.Lock()
+	held, err := l.file.Stat()
+	if err == nil {
+		pid, err = l.recordedOwner()
+	}
+	l.mu.Unlock()
+
+	if err != nil {
+		return false, err
+	}
+
+	if pid > 0 && processAlive(pid) {
+		return false, nil
+	}
+
+	// the file may have been replaced or touched before it was locked
+	fi, stale, err := l.stale(maxAge)
+	if err != nil || !stale || !os.SameFile(held, fi) {
+		return false, err
+	}
+
+	logger := l.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	logger.Warn("breaking stale lock", "file", l.Path, "modified", fi.ModTime(), "owner", pid)
+
+	err = os.Remove(l.Path)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// stale returns the info of the lock file and whether it exists and is
+// older than maxAge.
+func (l *FcntlLockfile) stale(maxAge time.Duration) (os.FileInfo, bool, error) {
+	fi, err := os.Stat(l.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, false, nil
+	}
+
+	if err != nil {
+		return nil, false, err
+	}
+
+	return fi, clock.OrReal(l.Clock).Now().Sub(fi.ModTime()) >= maxAge, nil
+}
+
+// recordedOwner returns the pid the lock file holds, or zero if it does
+// not hold one. The file is read through the locked descriptor, as
+// closing another one would drop the lock. The caller must hold mu.
+func (l *FcntlLockfile) recordedOwner() (int, error) {
+	buf := make([]byte, 32)
+
+	n, err := l.file.ReadAt(buf, 0)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(buf[:n])))
+	if err != nil {
+		return 0, nil
+	}
+
+	return pid, nil
+}
+
+// processAlive reports whether the process pid exists. A process owned by
+// another user is reported as alive.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+
+	return err == nil || err == syscall.EPERM
+}
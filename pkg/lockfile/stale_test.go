@@ -0,0 +1,106 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd || dragonfly
+// +build linux darwin freebsd openbsd netbsd dragonfly
+
+package lockfile
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/matbits/counter/pkg/clock"
+)
+
+func TestBreakStaleLock(t *testing.T) {
+	tests := []struct {
+		name        string
+		missing     bool
+		age         time.Duration
+		heldByOther bool
+		heldBySelf  bool
+		owner       string
+		want        bool
+	}{
+		{name: "stale", age: time.Hour, want: true},
+		{name: "fresh", age: time.Second},
+		{name: "missing", missing: true},
+		{name: "held by another process", age: time.Hour, heldByOther: true},
+		{name: "held by the same instance", age: time.Hour, heldBySelf: true},
+		{name: "live owner", age: time.Hour, owner: "live"},
+		{name: "dead owner", age: time.Hour, owner: "dead", want: true},
+		{name: "fresh, dead owner", age: time.Second, owner: "dead"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := lockPath(t)
+
+			if !tt.missing {
+				var content string
+
+				switch tt.owner {
+				case "live":
+					content = strconv.Itoa(os.Getpid())
+				case "dead":
+					content = strconv.Itoa(deadPid(t))
+				}
+
+				err := os.WriteFile(path, []byte(content+"\n"), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if tt.heldByOther {
+				hold(t, "hold-write", path)
+			}
+
+			modified := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+			l := NewFcntlLockfile(path)
+			l.Clock = clock.NewFake(modified.Add(tt.age))
+
+			if tt.heldBySelf {
+				err := l.LockWrite()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				defer l.Unlock()
+			}
+
+			if !tt.missing {
+				err := os.Chtimes(path, modified, modified)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := l.BreakStaleLock(time.Minute)
+			if err != nil || got != tt.want {
+				t.Fatalf("BreakStaleLock() = %v, %v, want %v, nil", got, err, tt.want)
+			}
+
+			_, err = os.Stat(path)
+			if exists := err == nil; exists != (!tt.missing && !tt.want) {
+				t.Errorf("lock file exists: %v, want %v", exists, !tt.missing && !tt.want)
+			}
+		})
+	}
+}
+
+// deadPid returns the pid of a process which has exited.
+func deadPid(t *testing.T) int {
+	t.Helper()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+
+	err := cmd.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cmd.ProcessState.Pid()
+}
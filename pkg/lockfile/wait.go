@@ -0,0 +1,120 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd || dragonfly || windows
+// +build linux darwin freebsd openbsd netbsd dragonfly windows
+
+package lockfile
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/matbits/counter/pkg/clock"
+)
+
+// DefaultRetryInterval is the retry interval used by the context aware
+// lock functions if RetryInterval is not set.
+const DefaultRetryInterval = 100 * time.Millisecond
+
+// LockReadCtx tries to lock the file for reading until it succeeds or
+// ctx is done. It returns ctx.Err() if ctx is done first.
+func (l *Lockfile) LockReadCtx(ctx context.Context) error {
+	return l.lockCtx(ctx, false)
+}
+
+// LockWriteCtx tries to lock the file for writing until it succeeds or
+// ctx is done. It returns ctx.Err() if ctx is done first.
+func (l *Lockfile) LockWriteCtx(ctx context.Context) error {
+	return l.lockCtx(ctx, true)
+}
+
+// LockWriteDeadline tries to lock the file for writing until it succeeds
+// or t is reached, in which case ErrLockTimeout is returned. The file is
+// polled every RetryInterval.
+func (l *Lockfile) LockWriteDeadline(t time.Time) error {
+	clk := clock.OrReal(l.Clock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	expired := clk.After(t.Sub(clk.Now()))
+
+	go func() {
+		select {
+		case <-expired:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	err := l.lockCtx(ctx, true)
+	if errors.Is(err, context.Canceled) {
+		return ErrLockTimeout
+	}
+
+	return err
+}
+
+// LockWriteTimeout is LockWriteDeadline with a deadline d from now.
+func (l *Lockfile) LockWriteTimeout(d time.Duration) error {
+	return l.LockWriteDeadline(clock.OrReal(l.Clock).Now().Add(d))
+}
+
+// LockWriteBackoff tries to lock the file for writing until it succeeds
+// or ctx is done, in which case ctx.Err() is returned. Unlike LockWriteB
+// it polls: the wait between two attempts starts at initial, or
+// RetryInterval if initial is not positive, and doubles up to maxWait.
+func (l *Lockfile) LockWriteBackoff(ctx context.Context, initial, maxWait time.Duration) error {
+	clk := clock.OrReal(l.Clock)
+
+	wait := initial
+	if wait <= 0 {
+		wait = l.RetryInterval
+	}
+	if wait <= 0 {
+		wait = DefaultRetryInterval
+	}
+
+	maxWait = max(maxWait, wait)
+
+	for attempt := 1; ; attempt++ {
+		err := l.lock(true, false, 0, io.SeekStart, 0)
+		if !errors.Is(err, ErrFailedToLock) {
+			return err
+		}
+
+		if l.Logger != nil {
+			l.Logger.Debug("lock is held, retrying", "file", l.Path, "attempt", attempt, "wait", wait, "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-clk.After(wait):
+		}
+
+		wait = min(wait*2, maxWait)
+	}
+}
+
+func (l *Lockfile) lockCtx(ctx context.Context, exclusive bool) error {
+	interval := l.RetryInterval
+	if interval <= 0 {
+		interval = DefaultRetryInterval
+	}
+
+	clk := clock.OrReal(l.Clock)
+
+	for {
+		err := l.lock(exclusive, false, 0, io.SeekStart, 0)
+		if !errors.Is(err, ErrFailedToLock) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-clk.After(interval):
+		}
+	}
+}